@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// readNames reads the names to resolve from path, or from stdin when path is
+// "-". Every line is a name, or a name and a record type as "name,type".
+// Blank lines and lines starting with # are skipped.
+func readNames(path string) ([]string, error) {
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	names := []string{}
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return names, nil
+}
+
+// parseEntry splits an input line into the name and its record type. A line
+// without a type uses defaultType, the one given with -t. Fully qualified
+// names lose their final dot, since resolve adds it back.
+func parseEntry(entry string, defaultType RecordType) (string, RecordType, error) {
+	name, typ, found := strings.Cut(entry, ",")
+	name = strings.TrimSpace(name)
+	if len(name) > 1 {
+		name = strings.TrimSuffix(name, ".")
+	}
+	if !found {
+		return name, defaultType, nil
+	}
+
+	typ = strings.ToUpper(strings.TrimSpace(typ))
+	recordType, exists := RecordTypes[typ]
+	if !exists {
+		return name, 0, fmt.Errorf("record type %s doesn't exist", typ)
+	}
+	return name, recordType, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEntry(t *testing.T) {
+	tests := []struct {
+		entry string
+		name  string
+		typ   RecordType
+		err   bool
+	}{
+		{"example.com", "example.com", TYPE_A, false},
+		{"example.com.", "example.com", TYPE_A, false},
+		{"  example.com  ", "example.com", TYPE_A, false},
+		{"example.com,mx", "example.com", TYPE_MX, false},
+		{"example.com. , AAAA ", "example.com", TYPE_AAAA, false},
+		{"_sip._tcp.example.com,SRV", "_sip._tcp.example.com", TYPE_SRV, false},
+		// the root keeps its dot, without it there would be no name left
+		{".,NS", ".", TYPE_NS, false},
+		{"example.com,", "example.com", 0, true},
+		{"example.com,HINFO", "example.com", 0, true},
+		{"example.com,A,extra", "example.com", 0, true},
+	}
+	for _, test := range tests {
+		name, typ, err := parseEntry(test.entry, TYPE_A)
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v, want an error: %v", test.entry, err, test.err)
+			continue
+		}
+		if name != test.name || (!test.err && typ != test.typ) {
+			t.Errorf("%q: got %q %d, want %q %d", test.entry, name, typ, test.name, test.typ)
+		}
+	}
+}
+
+func TestReadNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"one name per line", "a.example\nb.example\n", []string{"a.example", "b.example"}},
+		{"blank lines and comments", "# names to check\n\na.example\n   \n  # indented comment\nb.example,MX\n", []string{"a.example", "b.example,MX"}},
+		{"white space and CRLF", "  a.example  \r\nb.example\r\n", []string{"a.example", "b.example"}},
+		{"no final newline", "a.example", []string{"a.example"}},
+		{"empty", "", []string{}},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "names")
+		if err := os.WriteFile(path, []byte(test.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		names, err := readNames(path)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if strings.Join(names, "|") != strings.Join(test.want, "|") || len(names) != len(test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, names, test.want)
+		}
+	}
+
+	if _, err := readNames(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("a missing file was accepted")
+	}
+}
+
+func TestReadNamesFromStdin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(path, []byte("a.example\n# skipped\nb.example,TXT\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	defer func(old *os.File) { os.Stdin = old }(os.Stdin)
+	os.Stdin = stdin
+
+	names, err := readNames("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names, "|"); got != "a.example|b.example,TXT" {
+		t.Errorf("got %q from stdin", got)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxCachedChain limits how many cached CNAMEs are followed for one answer
+const maxCachedChain = 8
+
+// cacheSweepInterval is how often Add drops every expired entry, so a long
+// running server doesn't keep records nobody asks for again
+const cacheSweepInterval = time.Minute
+
+// cacheKey identifies one RRset: all records sharing a name, type and class
+type cacheKey struct {
+	name  string
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+}
+
+// cacheRank says which section of a response an RRset came from. Following
+// RFC 2181 section 5.4.1 data from the answer section is trusted more than
+// the referral NS records of an authority section, and those more than glue.
+type cacheRank int
+
+const (
+	rankAdditional cacheRank = iota
+	rankAuthority
+	rankAnswer
+)
+
+// cachedRecord is a resource together with the moment its TTL runs out and
+// the rank of the section it came from
+type cachedRecord struct {
+	resource dnsmessage.Resource
+	expires  time.Time
+	rank     cacheRank
+}
+
+// negativeEntry remembers that a name (NXDOMAIN) or a type at a name (NODATA)
+// doesn't exist, together with the SOA record that told us so. With -dnssec the
+// NSEC, NSEC3 and RRSIG records proving it are kept next to the SOA.
+type negativeEntry struct {
+	rcode       dnsmessage.RCode
+	authorities []dnsmessage.Resource
+	expires     time.Time
+}
+
+// Cache keeps every record the resolver has seen for as long as its TTL allows.
+// Names and types that don't exist are kept apart in negatives (RFC 2308).
+// RRSIG records are kept in signatures under the type they cover, so the
+// signatures of every RRset can be found next to it. An answer expanded from
+// a wildcard keeps the NSEC or NSEC3 records proving the name itself doesn't
+// exist in proofs, which DNSSEC needs to trust it.
+type Cache struct {
+	entries    map[cacheKey][]cachedRecord
+	signatures map[cacheKey][]cachedRecord
+	proofs     map[cacheKey][]cachedRecord
+	negatives  map[cacheKey]negativeEntry
+	lastSweep  time.Time
+	mutex      sync.Mutex // the server resolves queries concurrently, so the maps need protecting
+}
+
+// resolverCache is shared by every lookup this process makes
+var resolverCache = NewCache()
+
+func NewCache() *Cache {
+	return &Cache{
+		entries:    map[cacheKey][]cachedRecord{},
+		signatures: map[cacheKey][]cachedRecord{},
+		proofs:     map[cacheKey][]cachedRecord{},
+		negatives:  map[cacheKey]negativeEntry{},
+		lastSweep:  time.Now(),
+	}
+}
+
+// names are case insensitive, so the key always uses the lower case form
+func newCacheKey(name string, typ dnsmessage.Type, class dnsmessage.Class) cacheKey {
+	return cacheKey{name: strings.ToLower(name), typ: typ, class: class}
+}
+
+// Add stores the records of one section of a response, rank says which. The
+// records of one RRset replace whatever was cached for that RRset before, since
+// the newest copy wins, unless the cached copy is still valid and came from a
+// section ranked higher. Glue or a parent's NS records never overwrite an answer.
+// The signatures of an RRset are replaced together with it, so the cache never
+// pairs records with RRSIGs made over different data.
+func (c *Cache) Add(resources []dnsmessage.Resource, rank cacheRank) {
+	now := time.Now()
+
+	/* group the records into RRsets first so a set is replaced as a whole */
+	fresh := map[cacheKey][]cachedRecord{}
+	freshSignatures := map[cacheKey][]cachedRecord{}
+	for _, resource := range resources {
+		// the OPT pseudo record and zero TTL records must never be cached
+		if resource.Header.Type == dnsmessage.TypeOPT || resource.Header.TTL == 0 {
+			continue
+		}
+		record := cachedRecord{
+			resource: resource,
+			expires:  now.Add(time.Duration(resource.Header.TTL) * time.Second),
+			rank:     rank,
+		}
+		if covered := coveredType(resource); covered != 0 {
+			key := newCacheKey(resource.Header.Name.String(), covered, resource.Header.Class)
+			freshSignatures[key] = append(freshSignatures[key], record)
+			continue
+		}
+		key := newCacheKey(resource.Header.Name.String(), resource.Header.Type, resource.Header.Class)
+		fresh[key] = append(fresh[key], record)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, records := range fresh {
+		if cached := c.entries[key]; len(cached) > 0 && cached[0].rank > rank && stillValid(cached, now) {
+			continue
+		}
+		c.entries[key] = records
+		delete(c.proofs, key)
+		/* signatures without the RRset they cover are of no use and are dropped */
+		if signatures, ok := freshSignatures[key]; ok {
+			c.signatures[key] = signatures
+		} else {
+			delete(c.signatures, key)
+		}
+	}
+
+	/* expired entries are otherwise only dropped when their key is looked up again */
+	if now.Sub(c.lastSweep) >= cacheSweepInterval {
+		c.sweep(now)
+	}
+}
+
+// AddProof stores the NSEC or NSEC3 records, and their signatures, that came
+// with answers in the authority section. Call it after Add, they are kept
+// for as long as the RRsets of answers are.
+func (c *Cache) AddProof(answers []dnsmessage.Resource, proof []dnsmessage.Resource) {
+	now := time.Now()
+	records := []cachedRecord{}
+	for _, resource := range proof {
+		records = append(records, cachedRecord{
+			resource: resource,
+			expires:  now.Add(time.Duration(resource.Header.TTL) * time.Second),
+			rank:     rankAuthority,
+		})
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, answer := range answers {
+		if answer.Header.Type == typeRRSIG {
+			continue
+		}
+		c.proofs[newCacheKey(answer.Header.Name.String(), answer.Header.Type, answer.Header.Class)] = records
+	}
+}
+
+// stillValid reports whether any of records hasn't expired by now
+func stillValid(records []cachedRecord, now time.Time) bool {
+	for _, record := range records {
+		if record.expires.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweep drops every record and negative entry that has expired by now.
+// The caller holds the mutex.
+func (c *Cache) sweep(now time.Time) {
+	for _, entries := range []map[cacheKey][]cachedRecord{c.entries, c.signatures, c.proofs} {
+		for key, records := range entries {
+			valid := records[:0]
+			for _, record := range records {
+				if record.expires.After(now) {
+					valid = append(valid, record)
+				}
+			}
+			if len(valid) == 0 {
+				delete(entries, key)
+			} else {
+				entries[key] = valid
+			}
+		}
+	}
+	for key, entry := range c.negatives {
+		if !entry.expires.After(now) {
+			delete(c.negatives, key)
+		}
+	}
+	c.lastSweep = now
+}
+
+// Get returns the records of one RRset that are still valid. The TTL of each
+// returned record is counted down to the time it has left in the cache.
+func (c *Cache) Get(name string, typ dnsmessage.Type, class dnsmessage.Class) ([]dnsmessage.Resource, bool) {
+	return c.get(c.entries, newCacheKey(name, typ, class))
+}
+
+// Signatures returns the cached RRSIG records over the RRset of name, typ and class
+func (c *Cache) Signatures(name string, typ dnsmessage.Type, class dnsmessage.Class) []dnsmessage.Resource {
+	signatures, _ := c.get(c.signatures, newCacheKey(name, typ, class))
+	return signatures
+}
+
+// get returns the valid records under key in one of the cache's maps
+func (c *Cache) get(entries map[cacheKey][]cachedRecord, key cacheKey) ([]dnsmessage.Resource, bool) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	resources := []dnsmessage.Resource{}
+	for _, record := range entries[key] {
+		remaining := record.expires.Sub(now)
+		if remaining <= 0 {
+			continue
+		}
+		resource := record.resource
+		// round up so a record that is still valid never reports a TTL of 0
+		resource.Header.TTL = uint32((remaining + time.Second - 1) / time.Second)
+		resources = append(resources, resource)
+	}
+
+	if len(resources) == 0 {
+		delete(entries, key)
+		return nil, false
+	}
+	return resources, true
+}
+
+// Answers looks up a cached answer to question. When the name itself is a
+// cached CNAME, the chain is followed through the cache to the final records.
+// The signatures over every RRset of the answer come along with it, and so do
+// the proofs cached with them by AddProof.
+func (c *Cache) Answers(question dnsmessage.Question) ([]dnsmessage.Resource, []dnsmessage.Resource, bool) {
+	answers := []dnsmessage.Resource{}
+	proofs := []dnsmessage.Resource{}
+	name := question.Name.String()
+
+	for i := 0; i < maxCachedChain; i++ {
+		if records, ok := c.Get(name, question.Type, question.Class); ok {
+			answers = append(answers, records...)
+			answers = append(answers, c.Signatures(name, question.Type, question.Class)...)
+			proof, _ := c.get(c.proofs, newCacheKey(name, question.Type, question.Class))
+			return answers, append(proofs, proof...), true
+		}
+
+		/* the name may be an alias, in which case the answer lives at its target */
+		if question.Type == dnsmessage.TypeCNAME {
+			return nil, nil, false
+		}
+		cnames, ok := c.Get(name, dnsmessage.TypeCNAME, question.Class)
+		if !ok {
+			return nil, nil, false
+		}
+		answers = append(answers, cnames...)
+		answers = append(answers, c.Signatures(name, dnsmessage.TypeCNAME, question.Class)...)
+		proof, _ := c.get(c.proofs, newCacheKey(name, dnsmessage.TypeCNAME, question.Class))
+		proofs = append(proofs, proof...)
+		name = cnames[0].Body.(*dnsmessage.CNAMEResource).CNAME.String()
+	}
+
+	return nil, nil, false
+}
+
+// AddNegative remembers that question has no answer. An NXDOMAIN covers every
+// type at the name, so it is stored under TypeALL; a NODATA only covers the
+// question's own type. Following RFC 2308 the entry lives for the smaller of
+// the SOA record's TTL and its MINIMUM field, and nothing is cached without a SOA.
+// Every authority is kept, negativeMessage picks the ones to answer with.
+func (c *Cache) AddNegative(question dnsmessage.Question, rcode dnsmessage.RCode, authorities []dnsmessage.Resource) {
+	for _, authority := range authorities {
+		soa, ok := authority.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+
+		ttl := authority.Header.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		if ttl == 0 {
+			return
+		}
+
+		typ := question.Type
+		if rcode == dnsmessage.RCodeNameError {
+			typ = dnsmessage.TypeALL
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.negatives[newCacheKey(question.Name.String(), typ, question.Class)] = negativeEntry{
+			rcode:       rcode,
+			authorities: authorities,
+			expires:     time.Now().Add(time.Duration(ttl) * time.Second),
+		}
+		return
+	}
+}
+
+// Negative reports whether question is known not to exist. It returns the
+// cached rcode and the SOA record (and its proof) to put in the authority section.
+func (c *Cache) Negative(question dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource, bool) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	/* a missing name answers every type, so check for an NXDOMAIN before a NODATA */
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeALL, question.Type} {
+		key := newCacheKey(question.Name.String(), typ, question.Class)
+		entry, ok := c.negatives[key]
+		if !ok {
+			continue
+		}
+
+		remaining := entry.expires.Sub(now)
+		if remaining <= 0 {
+			delete(c.negatives, key)
+			continue
+		}
+		authorities := []dnsmessage.Resource{}
+		for _, authority := range entry.authorities {
+			authority.Header.TTL = uint32((remaining + time.Second - 1) / time.Second)
+			authorities = append(authorities, authority)
+		}
+		return entry.rcode, authorities, true
+	}
+
+	return dnsmessage.RCodeSuccess, nil, false
+}
+
+// Nameservers returns the addresses of the nameservers of the closest zone
+// enclosing name for which both the NS set and its glue are still cached.
+// Only glue of the given address types (A and possibly AAAA) is used, IPv4
+// addresses first. Next to the addresses it returns the name of that zone.
+// A nil result means the lookup has to start at the root servers.
+func (c *Cache) Nameservers(name string, types []dnsmessage.Type) (string, []net.IP) {
+	for zone := name; zone != "."; zone = parentZone(zone) {
+		nsRecords, ok := c.Get(zone, dnsmessage.TypeNS, dnsmessage.ClassINET)
+		if !ok {
+			continue
+		}
+
+		servers := []net.IP{}
+		for _, typ := range types {
+			for _, ns := range nsRecords {
+				nameserver := ns.Body.(*dnsmessage.NSResource).NS.String()
+				glue, ok := c.Get(nameserver, typ, dnsmessage.ClassINET)
+				if !ok {
+					continue
+				}
+				for _, address := range glue {
+					ip, _ := recordIP(address.Body)
+					servers = append(servers, ip)
+				}
+			}
+		}
+
+		if len(servers) > 0 {
+			return zone, servers
+		}
+	}
+
+	return ".", nil
+}
+
+// parentZone strips the first label of a fully qualified name, "www.x.com." becomes "x.com."
+func parentZone(name string) string {
+	if name == "." {
+		return "."
+	}
+	if i := strings.Index(name, "."); i >= 0 && i < len(name)-1 {
+		return name[i+1:]
+	}
+	return "."
+}
+
+// isSubdomain reports whether name is zone itself or lies below it
+func isSubdomain(name, zone string) bool {
+	name, zone = strings.ToLower(name), strings.ToLower(zone)
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeRRSIG is an RRSIG over typ at name, only its type covered field is filled in
+func fakeRRSIG(name string, typ dnsmessage.Type) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: typeRRSIG, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.UnknownResource{Type: typeRRSIG, Data: []byte{byte(typ >> 8), byte(typ), 13, 2}},
+	}
+}
+
+func cachedAddress(t *testing.T, cache *Cache, name string) string {
+	t.Helper()
+	records, ok := cache.Get(name, dnsmessage.TypeA, dnsmessage.ClassINET)
+	if !ok || len(records) != 1 {
+		t.Fatalf("%s: %d cached records, want 1", name, len(records))
+	}
+	return answerStrings(records)[0]
+}
+
+func TestCacheRanking(t *testing.T) {
+	cache := NewCache()
+	cache.Add([]dnsmessage.Resource{fakeA("ns1.site.test.", 192, 0, 2, 1)}, rankAnswer)
+
+	/* glue and authority data for the same RRset don't replace the answer */
+	cache.Add([]dnsmessage.Resource{fakeA("ns1.site.test.", 6, 6, 6, 6)}, rankAdditional)
+	cache.Add([]dnsmessage.Resource{fakeA("ns1.site.test.", 6, 6, 6, 6)}, rankAuthority)
+	if got := cachedAddress(t, cache, "ns1.site.test."); got != "ns1.site.test. A 192.0.2.1" {
+		t.Errorf("glue replaced the answer: %s", got)
+	}
+
+	/* a newer answer does, and glue replaces glue */
+	cache.Add([]dnsmessage.Resource{fakeA("ns1.site.test.", 192, 0, 2, 2)}, rankAnswer)
+	if got := cachedAddress(t, cache, "ns1.site.test."); got != "ns1.site.test. A 192.0.2.2" {
+		t.Errorf("a newer answer didn't replace the old one: %s", got)
+	}
+	cache.Add([]dnsmessage.Resource{fakeA("ns2.site.test.", 10, 0, 0, 1)}, rankAdditional)
+	cache.Add([]dnsmessage.Resource{fakeA("ns2.site.test.", 10, 0, 0, 2)}, rankAdditional)
+	if got := cachedAddress(t, cache, "ns2.site.test."); got != "ns2.site.test. A 10.0.0.2" {
+		t.Errorf("newer glue didn't replace the old glue: %s", got)
+	}
+
+	/* an answer whose TTL ran out is replaced by anything */
+	cache.Add([]dnsmessage.Resource{fakeA("ns3.site.test.", 192, 0, 2, 3)}, rankAnswer)
+	key := newCacheKey("ns3.site.test.", dnsmessage.TypeA, dnsmessage.ClassINET)
+	cache.entries[key][0].expires = time.Now().Add(-time.Second)
+	cache.Add([]dnsmessage.Resource{fakeA("ns3.site.test.", 10, 0, 0, 3)}, rankAdditional)
+	if got := cachedAddress(t, cache, "ns3.site.test."); got != "ns3.site.test. A 10.0.0.3" {
+		t.Errorf("glue didn't replace an expired answer: %s", got)
+	}
+}
+
+func TestCacheSignaturesFollowTheirRRset(t *testing.T) {
+	cache := NewCache()
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("www.site.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	cache.Add([]dnsmessage.Resource{fakeA("www.site.test.", 192, 0, 2, 1), fakeRRSIG("www.site.test.", dnsmessage.TypeA)}, rankAnswer)
+	if answers, _, _ := cache.Answers(question); len(answers) != 2 {
+		t.Fatalf("got %d records, want the A record and its RRSIG", len(answers))
+	}
+
+	/* an unsigned copy replacing the set takes the old signatures with it */
+	cache.Add([]dnsmessage.Resource{fakeA("www.site.test.", 192, 0, 2, 2)}, rankAnswer)
+	if answers, _, _ := cache.Answers(question); len(answers) != 1 {
+		t.Errorf("got %d records, want only the new A record without the old RRSIG", len(answers))
+	}
+
+	/* a copy that isn't allowed to replace the set leaves its signatures alone too */
+	cache.Add([]dnsmessage.Resource{fakeA("www.site.test.", 192, 0, 2, 3), fakeRRSIG("www.site.test.", dnsmessage.TypeA)}, rankAnswer)
+	cache.Add([]dnsmessage.Resource{fakeA("www.site.test.", 6, 6, 6, 6)}, rankAdditional)
+	if answers, _, _ := cache.Answers(question); len(answers) != 2 || answerStrings(answers)[0] != "www.site.test. A 192.0.2.3" {
+		t.Errorf("got %v, want the signed answer", answerStrings(answers))
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsmessage has no DNAME type (RFC 6672) either, it only shows up in type bitmaps here
+const typeDNAME dnsmessage.Type = 39
+
+// maxNSEC3Iterations is the most extra hash iterations an NSEC3 proof may ask
+// for. Answers from zones using more are treated as insecure instead of
+// spending the CPU on them (RFC 9276 section 3.2).
+const maxNSEC3Iterations = 150
+
+// what the NSEC or NSEC3 records of a negative answer prove
+const (
+	proofNoName      = iota + 1 // the name doesn't exist
+	proofNoData                 // the name exists, but has no records of the type
+	proofInsecureCut            // the name is a delegation without DS records
+	proofInsecure               // nothing can be proven: NSEC3 opt-out, or parameters we don't check
+)
+
+// nsecRecord is a parsed NSEC record (RFC 4034 section 4.1): its owner and
+// the next name in the zone, with the types that exist at the owner
+type nsecRecord struct {
+	owner  string
+	next   string
+	bitmap []byte
+}
+
+// nsec3Record is a parsed NSEC3 record (RFC 5155 section 3.2). Instead of
+// names it orders the hashes of names, the owner's hash is its first label.
+type nsec3Record struct {
+	hash       []byte
+	next       []byte
+	algorithm  uint8
+	optOut     bool
+	iterations uint16
+	salt       []byte
+	bitmap     []byte
+}
+
+// proveDenial checks the NSEC or NSEC3 records in authorities, which must all
+// be signed by zone with one of keys, against a negative answer for name and
+// typ. With rcode NXDOMAIN they have to prove name doesn't exist, otherwise
+// that it has no records of typ. For a DS question they can also show name
+// is a delegation without DS records.
+func proveDenial(zone string, keys []*dnskey, name string, typ dnsmessage.Type, rcode dnsmessage.RCode, authorities []dnsmessage.Resource) (int, error) {
+	if rcode != dnsmessage.RCodeSuccess && rcode != dnsmessage.RCodeNameError {
+		return 0, fmt.Errorf("%s is not a denial", rcodeName(rcode))
+	}
+
+	nsecs, nsec3s, err := denialRecords(zone, keys, authorities)
+	if err != nil {
+		return 0, err
+	}
+
+	name = strings.ToLower(name)
+	nxdomain := rcode == dnsmessage.RCodeNameError
+	switch {
+	case len(nsecs) > 0:
+		return proveNSEC(zone, name, typ, nxdomain, nsecs)
+	case len(nsec3s) > 0:
+		return proveNSEC3(zone, name, typ, nxdomain, nsec3s)
+	}
+	return 0, fmt.Errorf("no NSEC or NSEC3 records prove that %s %s doesn't exist", name, typeName(typ))
+}
+
+// proveWildcard checks the proof that goes with an answer for name expanded
+// from the wildcard below encloser: an NSEC or NSEC3 record in authorities has
+// to show that no name closer to name than encloser exists, or the wildcard
+// wouldn't have matched (RFC 4035 section 5.3.4, RFC 5155 section 8.8).
+func proveWildcard(zone string, keys []*dnskey, name, encloser string, authorities []dnsmessage.Resource) (int, error) {
+	nsecs, nsec3s, err := denialRecords(zone, keys, authorities)
+	if err != nil {
+		return 0, err
+	}
+
+	name = strings.ToLower(name)
+	switch {
+	case len(nsecs) > 0:
+		cover := coveringNSEC(nsecs, name)
+		if cover == nil {
+			return 0, fmt.Errorf("no NSEC covers %s", name)
+		}
+		if closest := closestNSECEncloser(zone, name, cover); closest != encloser {
+			return 0, fmt.Errorf("the NSEC covering %s shows %s exists, not only %s", name, closest, encloser)
+		}
+		return proofNoName, nil
+	case len(nsec3s) > 0:
+		chain, ok, err := nsec3ChainOf(zone, nsec3s)
+		if !ok {
+			if err != nil {
+				return 0, err
+			}
+			return proofInsecure, nil
+		}
+		labels := nameLabels(name)
+		nextCloser := strings.Join(labels[len(labels)-len(nameLabels(encloser))-1:], ".") + "."
+		if chain.covering(nextCloser) == nil {
+			return 0, fmt.Errorf("no NSEC3 covers %s, the next closer name of %s", nextCloser, name)
+		}
+		return proofNoName, nil
+	}
+	return 0, fmt.Errorf("no NSEC or NSEC3 records prove that %s doesn't exist", name)
+}
+
+// denialRecords verifies and parses the NSEC and NSEC3 records of zone in
+// authorities. Records other zones signed belong to other proofs and are left out.
+func denialRecords(zone string, keys []*dnskey, authorities []dnsmessage.Resource) ([]*nsecRecord, []*nsec3Record, error) {
+	nsecs, nsec3s := []*nsecRecord{}, []*nsec3Record{}
+	for _, set := range groupRRsets(authorities) {
+		if set.typ != typeNSEC && set.typ != typeNSEC3 {
+			continue
+		}
+		if !isSubdomain(set.name, zone) || signedByOthers(set, zone) {
+			continue
+		}
+		if err := verifySigned(set, zone, keys); err != nil {
+			return nil, nil, err
+		}
+		for _, record := range set.records {
+			if set.typ == typeNSEC {
+				nsec, err := parseNSEC(record)
+				if err != nil {
+					return nil, nil, err
+				}
+				nsecs = append(nsecs, nsec)
+				continue
+			}
+			nsec3, err := parseNSEC3(record, zone)
+			if err != nil {
+				return nil, nil, err
+			}
+			nsec3s = append(nsec3s, nsec3)
+		}
+	}
+	return nsecs, nsec3s, nil
+}
+
+// signedByOthers is true when set has signatures, but none of them by zone
+func signedByOthers(set *rrset, zone string) bool {
+	for _, sig := range set.sigs {
+		if sig.signerName == zone {
+			return false
+		}
+	}
+	return len(set.sigs) > 0
+}
+
+// nsec3ChainOf checks that the NSEC3 records of zone share their hash
+// parameters. It isn't ok when they use an algorithm we don't know or more
+// iterations than we hash, the answer then can't be checked.
+func nsec3ChainOf(zone string, records []*nsec3Record) (nsec3Chain, bool, error) {
+	params := records[0]
+	for _, record := range records {
+		if record.algorithm != 1 || record.iterations > maxNSEC3Iterations {
+			return nsec3Chain{}, false, nil
+		}
+		if record.iterations != params.iterations || !bytes.Equal(record.salt, params.salt) {
+			return nsec3Chain{}, false, fmt.Errorf("the NSEC3 records of %s use different parameters", zone)
+		}
+	}
+	return nsec3Chain{records: records, iterations: params.iterations, salt: params.salt}, true, nil
+}
+
+// proveNSEC checks a denial with NSEC records (RFC 4035 section 5.4). A
+// missing name needs an NSEC covering it and one covering the wildcard that
+// could have matched it. A missing type needs the NSEC of the name itself,
+// the one before an empty non-terminal, or the one of the wildcard that
+// matched the name.
+func proveNSEC(zone, name string, typ dnsmessage.Type, nxdomain bool, nsecs []*nsecRecord) (int, error) {
+	if nxdomain {
+		cover := coveringNSEC(nsecs, name)
+		if cover == nil {
+			return 0, fmt.Errorf("no NSEC covers %s", name)
+		}
+		wildcard := wildcardOf(closestNSECEncloser(zone, name, cover))
+		if matchingNSEC(nsecs, wildcard) != nil {
+			return 0, fmt.Errorf("%s exists, so %s can't be missing", wildcard, name)
+		}
+		if coveringNSEC(nsecs, wildcard) == nil {
+			return 0, fmt.Errorf("no NSEC proves there is no wildcard %s", wildcard)
+		}
+		return proofNoName, nil
+	}
+
+	if match := matchingNSEC(nsecs, name); match != nil {
+		return typeDenial("NSEC", name, typ, match.bitmap)
+	}
+	if cover := coveringNSEC(nsecs, name); cover != nil {
+		/* an empty non-terminal has no NSEC of its own, the one before it points at a name below it */
+		if isSubdomain(cover.next, name) {
+			return proofNoData, nil
+		}
+		wildcard := wildcardOf(closestNSECEncloser(zone, name, cover))
+		if match := matchingNSEC(nsecs, wildcard); match != nil {
+			return typeDenial("NSEC", wildcard, typ, match.bitmap)
+		}
+	}
+	return 0, fmt.Errorf("no NSEC proves that %s has no %s records", name, typeName(typ))
+}
+
+// proveNSEC3 checks a denial with NSEC3 records (RFC 5155 section 8). Most
+// proofs start from the closest encloser: the longest existing ancestor of
+// the name, whose child towards the name, the next closer name, is covered.
+func proveNSEC3(zone, name string, typ dnsmessage.Type, nxdomain bool, records []*nsec3Record) (int, error) {
+	/* the records of one zone share their parameters, anything unknown or costly leaves the answer unchecked */
+	chain, ok, err := nsec3ChainOf(zone, records)
+	if !ok {
+		if err != nil {
+			return 0, err
+		}
+		return proofInsecure, nil
+	}
+
+	if nxdomain {
+		encloser, cover, err := chain.closestEncloser(zone, name)
+		if err != nil {
+			return 0, err
+		}
+		/* an opt-out span may hide unsigned delegations, so the name may exist below one (RFC 5155 section 9.2) */
+		if cover.optOut {
+			return proofInsecure, nil
+		}
+		wildcard := wildcardOf(encloser)
+		if chain.matching(wildcard) != nil {
+			return 0, fmt.Errorf("%s exists, so %s can't be missing", wildcard, name)
+		}
+		if chain.covering(wildcard) == nil {
+			return 0, fmt.Errorf("no NSEC3 proves there is no wildcard %s", wildcard)
+		}
+		return proofNoName, nil
+	}
+
+	if match := chain.matching(name); match != nil {
+		return typeDenial("NSEC3", name, typ, match.bitmap)
+	}
+	encloser, cover, err := chain.closestEncloser(zone, name)
+	if err != nil {
+		return 0, err
+	}
+	/* an insecure delegation in an opt-out span has no NSEC3 of its own (RFC 5155 section 8.6) */
+	if typ == typeDS && cover.optOut {
+		return proofInsecureCut, nil
+	}
+	wildcard := wildcardOf(encloser)
+	if match := chain.matching(wildcard); match != nil {
+		return typeDenial("NSEC3", wildcard, typ, match.bitmap)
+	}
+	return 0, fmt.Errorf("no NSEC3 proves that %s has no %s records", name, typeName(typ))
+}
+
+// typeDenial checks the type bitmap of the NSEC or NSEC3 record of name for
+// a NODATA answer to typ. At a delegation the parent only knows the NS and DS
+// records, so it can only deny the DS set, and for DS only the parent's
+// record counts, not the one at the apex of the child.
+func typeDenial(kind, name string, typ dnsmessage.Type, bitmap []byte) (int, error) {
+	atCut := hasType(bitmap, dnsmessage.TypeNS) && !hasType(bitmap, dnsmessage.TypeSOA)
+	switch {
+	case hasType(bitmap, typ):
+		return 0, fmt.Errorf("the %s record of %s says it has %s records", kind, name, typeName(typ))
+	case typ != dnsmessage.TypeCNAME && hasType(bitmap, dnsmessage.TypeCNAME):
+		return 0, fmt.Errorf("the %s record of %s says it is an alias", kind, name)
+	case typ == typeDS && hasType(bitmap, dnsmessage.TypeSOA) && name != ".":
+		return 0, fmt.Errorf("the %s record of %s comes from the child zone", kind, name)
+	case typ == typeDS && atCut:
+		return proofInsecureCut, nil
+	case atCut:
+		return 0, fmt.Errorf("%s is a delegation, the %s record of its parent can't deny %s records", name, kind, typeName(typ))
+	}
+	return proofNoData, nil
+}
+
+// matchingNSEC returns the NSEC owned by name, or nil
+func matchingNSEC(nsecs []*nsecRecord, name string) *nsecRecord {
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.owner, name) {
+			return nsec
+		}
+	}
+	return nil
+}
+
+// coveringNSEC returns the NSEC whose span between its owner and the next
+// name holds name, or nil. The last NSEC of a zone points back at the apex.
+// An NSEC at a delegation or DNAME above name can't cover it, the names below
+// belong to another zone (RFC 6840 section 4.1).
+func coveringNSEC(nsecs []*nsecRecord, name string) *nsecRecord {
+	for _, nsec := range nsecs {
+		covered := canonicalCompare(nsec.owner, name) < 0 && canonicalCompare(name, nsec.next) < 0
+		if canonicalCompare(nsec.owner, nsec.next) >= 0 {
+			covered = canonicalCompare(nsec.owner, name) < 0
+		}
+		if !covered {
+			continue
+		}
+		if isSubdomain(name, nsec.owner) && (hasType(nsec.bitmap, typeDNAME) ||
+			(hasType(nsec.bitmap, dnsmessage.TypeNS) && !hasType(nsec.bitmap, dnsmessage.TypeSOA))) {
+			continue
+		}
+		return nsec
+	}
+	return nil
+}
+
+// closestNSECEncloser is the longest ancestor of name that exists according
+// to the NSEC covering it: the longest one name shares with either end of the span
+func closestNSECEncloser(zone, name string, cover *nsecRecord) string {
+	encloser := commonAncestor(name, cover.owner)
+	if next := commonAncestor(name, cover.next); len(next) > len(encloser) {
+		encloser = next
+	}
+	if !isSubdomain(encloser, zone) {
+		return zone
+	}
+	return encloser
+}
+
+// nsec3Chain is the NSEC3 records of one answer with the zone's hash parameters
+type nsec3Chain struct {
+	records    []*nsec3Record
+	iterations uint16
+	salt       []byte
+}
+
+// matching returns the NSEC3 record whose owner is the hash of name, or nil
+func (c nsec3Chain) matching(name string) *nsec3Record {
+	hash := nsec3Hash(name, c.salt, c.iterations)
+	for _, record := range c.records {
+		if bytes.Equal(record.hash, hash) {
+			return record
+		}
+	}
+	return nil
+}
+
+// covering returns the NSEC3 record whose span of hashes holds the hash of name, or nil
+func (c nsec3Chain) covering(name string) *nsec3Record {
+	hash := nsec3Hash(name, c.salt, c.iterations)
+	for _, record := range c.records {
+		covered := bytes.Compare(record.hash, hash) < 0 && bytes.Compare(hash, record.next) < 0
+		if bytes.Compare(record.hash, record.next) >= 0 {
+			covered = bytes.Compare(record.hash, hash) < 0 || bytes.Compare(hash, record.next) < 0
+		}
+		if covered {
+			return record
+		}
+	}
+	return nil
+}
+
+// closestEncloser finds the closest encloser proof of name (RFC 5155 section
+// 8.3): an ancestor with an NSEC3 of its own whose next closer name is
+// covered. It returns the encloser and the NSEC3 covering the next closer name.
+func (c nsec3Chain) closestEncloser(zone, name string) (string, *nsec3Record, error) {
+	nextCloser := name
+	for encloser := parentZone(name); isSubdomain(encloser, zone); encloser = parentZone(encloser) {
+		if match := c.matching(encloser); match != nil {
+			/* below a delegation or a DNAME the names belong to another zone */
+			if hasType(match.bitmap, typeDNAME) ||
+				(hasType(match.bitmap, dnsmessage.TypeNS) && !hasType(match.bitmap, dnsmessage.TypeSOA)) {
+				return "", nil, fmt.Errorf("the closest encloser %s of %s is a delegation", encloser, name)
+			}
+			cover := c.covering(nextCloser)
+			if cover == nil {
+				return "", nil, fmt.Errorf("no NSEC3 covers %s, the next closer name of %s", nextCloser, name)
+			}
+			return encloser, cover, nil
+		}
+		if encloser == zone || encloser == "." {
+			break
+		}
+		nextCloser = encloser
+	}
+	return "", nil, fmt.Errorf("no NSEC3 proves the closest encloser of %s", name)
+}
+
+// nsec3Hash hashes name the NSEC3 way (RFC 5155 section 5): SHA-1 over the
+// name in canonical form and the salt, then iterations more times over the
+// previous hash and the salt
+func nsec3Hash(name string, salt []byte, iterations uint16) []byte {
+	h := sha1.New()
+	h.Write(wireName(name))
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(nil)
+	}
+	return digest
+}
+
+// hasType reports whether the type bitmap of an NSEC or NSEC3 record lists
+// typ. The bitmap is a series of windows of 256 types (RFC 4034 section 4.1.2).
+func hasType(bitmap []byte, typ dnsmessage.Type) bool {
+	window, bit := byte(typ>>8), byte(typ)
+	for len(bitmap) >= 2 {
+		length := int(bitmap[1])
+		if length == 0 || length > 32 || 2+length > len(bitmap) {
+			return false
+		}
+		if bitmap[0] == window {
+			index := int(bit / 8)
+			return index < length && bitmap[2+index]&(0x80>>(bit%8)) != 0
+		}
+		bitmap = bitmap[2+length:]
+	}
+	return false
+}
+
+// parseNSEC decodes an NSEC record: the next name, then the type bitmap
+func parseNSEC(resource dnsmessage.Resource) (*nsecRecord, error) {
+	record, ok := resource.Body.(*dnsmessage.UnknownResource)
+	if !ok {
+		return nil, fmt.Errorf("malformed NSEC record")
+	}
+	next, offset, err := readWireName(record.Data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("malformed NSEC record: %w", err)
+	}
+	return &nsecRecord{owner: strings.ToLower(resource.Header.Name.String()), next: next, bitmap: record.Data[offset:]}, nil
+}
+
+// parseNSEC3 decodes an NSEC3 record of zone: hash algorithm, flags,
+// iterations, salt, next hashed owner and type bitmap. The owner must be the
+// base32hex encoded hash right below the zone's apex.
+func parseNSEC3(resource dnsmessage.Resource, zone string) (*nsec3Record, error) {
+	record, ok := resource.Body.(*dnsmessage.UnknownResource)
+	if !ok || len(record.Data) < 5 {
+		return nil, fmt.Errorf("malformed NSEC3 record")
+	}
+	data := record.Data
+
+	owner := strings.ToLower(resource.Header.Name.String())
+	label, rest, _ := strings.Cut(owner, ".")
+	if rest == "" {
+		rest = "."
+	}
+	hash, err := base32.HexEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(label))
+	if err != nil || !strings.EqualFold(rest, zone) {
+		return nil, fmt.Errorf("NSEC3 owner %s is not a hash in zone %s", owner, zone)
+	}
+
+	saltLength := int(data[4])
+	if len(data) < 5+saltLength+1 {
+		return nil, fmt.Errorf("malformed NSEC3 record")
+	}
+	hashLength := int(data[5+saltLength])
+	offset := 6 + saltLength + hashLength
+	if len(data) < offset {
+		return nil, fmt.Errorf("malformed NSEC3 record")
+	}
+	return &nsec3Record{
+		hash:       hash,
+		next:       data[6+saltLength : offset],
+		algorithm:  data[0],
+		optOut:     data[1]&1 != 0,
+		iterations: binary.BigEndian.Uint16(data[2:4]),
+		salt:       data[5 : 5+saltLength],
+		bitmap:     data[offset:],
+	}, nil
+}
+
+// canonicalCompare orders two names the DNSSEC way (RFC 4034 section 6.1):
+// label by label from the right, each label compared as lower case bytes,
+// and a name sorts before the names below it
+func canonicalCompare(a, b string) int {
+	aLabels, bLabels := nameLabels(a), nameLabels(b)
+	for i := 1; i <= len(aLabels) && i <= len(bLabels); i++ {
+		if c := strings.Compare(aLabels[len(aLabels)-i], bLabels[len(bLabels)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
+
+// commonAncestor returns the longest name both a and b are at or below
+func commonAncestor(a, b string) string {
+	aLabels, bLabels := nameLabels(a), nameLabels(b)
+	common := []string{}
+	for i := 1; i <= len(aLabels) && i <= len(bLabels) && aLabels[len(aLabels)-i] == bLabels[len(bLabels)-i]; i++ {
+		common = append([]string{aLabels[len(aLabels)-i]}, common...)
+	}
+	if len(common) == 0 {
+		return "."
+	}
+	return strings.Join(common, ".") + "."
+}
+
+// nameLabels splits a fully qualified name into its lower case labels, none for the root
+func nameLabels(name string) []string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// wildcardOf returns the wildcard name right below encloser
+func wildcardOf(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
@@ -0,0 +1,896 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnssecEnabled is set with -dnssec. Queries then carry the DO bit and every
+// answer is validated from the root trust anchor down.
+var dnssecEnabled = false
+
+// the DNSSEC record types (RFC 4034), dnsmessage only has them as UnknownResource
+const (
+	typeDS     dnsmessage.Type = 43
+	typeRRSIG  dnsmessage.Type = 46
+	typeNSEC   dnsmessage.Type = 47
+	typeDNSKEY dnsmessage.Type = 48
+	typeNSEC3  dnsmessage.Type = 50
+)
+
+// the outcome of validating an answer (RFC 4035 section 4.3)
+const (
+	statusSecure   = "secure"
+	statusInsecure = "insecure"
+	statusBogus    = "bogus"
+)
+
+// rootTrustAnchors are the DS records of the root zone's key signing keys as
+// IANA publishes them, "key tag, algorithm, digest type, digest". They can be
+// replaced with -trust-anchor, for example to validate a local test hierarchy.
+var rootTrustAnchors = []string{
+	"20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// dnskey is a parsed DNSKEY record, rdata is kept for the key tag and DS digests
+type dnskey struct {
+	flags     uint16
+	protocol  uint8
+	algorithm uint8
+	publicKey []byte
+	rdata     []byte
+}
+
+// dsRecord is a parsed DS record, the parent's fingerprint of a child key
+type dsRecord struct {
+	keyTag     uint16
+	algorithm  uint8
+	digestType uint8
+	digest     []byte
+}
+
+// rrsig is a parsed RRSIG record
+type rrsig struct {
+	typeCovered dnsmessage.Type
+	algorithm   uint8
+	labels      uint8
+	originalTTL uint32
+	expiration  uint32
+	inception   uint32
+	keyTag      uint16
+	signerName  string
+	signature   []byte
+	rdata       []byte
+}
+
+// rrset is every record of one name and type together with the signatures over them
+type rrset struct {
+	name    string
+	typ     dnsmessage.Type
+	records []dnsmessage.Resource
+	sigs    []*rrsig
+}
+
+// validator checks the answers of one lookup. It remembers the keys of every
+// zone and every zone cut it found, so each is fetched and checked only once.
+type validator struct {
+	ctx   context.Context
+	zones map[string]zoneKeys
+	cuts  map[string]delegation
+}
+
+// zoneKeys is the outcome of validating the DNSKEY set of one zone
+type zoneKeys struct {
+	status string
+	keys   []*dnskey
+	err    error
+}
+
+// validateResponse validates the answer to question and returns secure,
+// insecure or bogus. For bogus answers the error says what broke the chain.
+// Answers are checked RRset by RRset, CNAMEs included, and the weakest status
+// wins. When the answer ends without records of the question's type, the
+// NSEC or NSEC3 records in the authority section have to prove they don't
+// exist. An answer made of local zone data only is insecure, there is no
+// chain of trust to check it against.
+func validateResponse(ctx context.Context, question dnsmessage.Question, response *Response) (string, error) {
+	if response.Local {
+		return statusInsecure, nil
+	}
+
+	v := &validator{ctx: ctx, zones: map[string]zoneKeys{}, cuts: map[string]delegation{}}
+	status, statusErr := v.validateRRsets(groupRRsets(response.Answers), response.Authorities)
+	if name := deniedName(question, response.Answers); name != "" {
+		denialStatus, err := v.validateDenial(name, question.Type, response.Header.RCode, response.Authorities)
+		if weaker(denialStatus, status) {
+			status, statusErr = denialStatus, err
+		}
+	}
+	return status, statusErr
+}
+
+// deniedName follows the CNAME chain in answers from the question's name and
+// returns the name it ends at when there are no records of the question's
+// type there, or "" when there are
+func deniedName(question dnsmessage.Question, answers []dnsmessage.Resource) string {
+	if question.Type == dnsmessage.TypeALL && len(answers) > 0 {
+		return ""
+	}
+	name := question.Name
+	for i := 0; i <= maxCNAMEChain; i++ {
+		if len(answersFor(answers, name, question.Type)) > 0 {
+			return ""
+		}
+		cnames := answersFor(answers, name, dnsmessage.TypeCNAME)
+		if question.Type == dnsmessage.TypeCNAME || len(cnames) == 0 {
+			return name.String()
+		}
+		name, _ = recordTarget(cnames[0].Body)
+	}
+	return ""
+}
+
+// validateRRsets validates each RRset and returns the weakest status. The
+// authorities have to prove the answers expanded from a wildcard.
+func (v *validator) validateRRsets(rrsets []*rrset, authorities []dnsmessage.Resource) (string, error) {
+	status := statusSecure
+	var statusErr error
+	for _, set := range rrsets {
+		setStatus, err := v.validateRRset(set, authorities)
+		if weaker(setStatus, status) {
+			status, statusErr = setStatus, err
+		}
+	}
+	return status, statusErr
+}
+
+// validateDenial checks a NXDOMAIN or NODATA answer for name and typ. In a
+// signed zone the NSEC or NSEC3 records have to be signed by the zone and
+// prove what rcode says (RFC 4035 section 5.4, RFC 5155 section 8).
+func (v *validator) validateDenial(name string, typ dnsmessage.Type, rcode dnsmessage.RCode, authorities []dnsmessage.Resource) (string, error) {
+	if localZoneOf(name) != nil {
+		return statusInsecure, nil
+	}
+
+	owner := name
+	if typ == typeDS {
+		owner = parentZone(name)
+	}
+	zone, keys := v.zoneFor(owner)
+	if keys.status != statusSecure {
+		return keys.status, keys.err
+	}
+
+	proof, err := proveDenial(zone, keys.keys, name, typ, rcode, authorities)
+	if err != nil {
+		return statusBogus, err
+	}
+	if proof == proofInsecure {
+		return statusInsecure, nil
+	}
+	return statusSecure, nil
+}
+
+// validateRRset is secure when one of the signatures over set verifies with
+// a key of the secure zone set belongs to. Only that zone's apex may sign it
+// (RFC 4035 section 5.3.1), a key of a zone above it can't. A set expanded
+// from a wildcard also needs the NSEC or NSEC3 records in authorities that
+// prove its name doesn't exist itself (RFC 4035 section 5.3.4).
+func (v *validator) validateRRset(set *rrset, authorities []dnsmessage.Resource) (string, error) {
+	/* a CNAME chain can lead into a local zone, whose records are never signed */
+	if localZoneOf(set.name) != nil {
+		return statusInsecure, nil
+	}
+
+	/* a DS set lives in the parent zone, so that's the zone that should have signed it */
+	owner := set.name
+	if set.typ == typeDS {
+		owner = parentZone(set.name)
+	}
+	zone, keys := v.zoneFor(owner)
+	if keys.status != statusSecure {
+		return keys.status, keys.err
+	}
+	return verifyExpanded(set, zone, keys.keys, authorities)
+}
+
+// verifyExpanded checks the signatures over set like verifySigned, and when
+// the one that verifies says set was expanded from a wildcard, the proof in
+// authorities that no closer name exists
+func verifyExpanded(set *rrset, zone string, keys []*dnskey, authorities []dnsmessage.Resource) (string, error) {
+	sig, err := signatureOf(set, zone, keys)
+	if err != nil {
+		return statusBogus, err
+	}
+	encloser := wildcardEncloser(set.name, sig)
+	if encloser == "" {
+		return statusSecure, nil
+	}
+	proof, err := proveWildcard(zone, keys, set.name, encloser, authorities)
+	if err != nil {
+		return statusBogus, fmt.Errorf("%s %s comes from the wildcard %s: %w", set.name, typeName(set.typ), wildcardOf(encloser), err)
+	}
+	if proof == proofInsecure {
+		return statusInsecure, nil
+	}
+	return statusSecure, nil
+}
+
+// verifySigned checks that one of the signatures over set was made by zone
+// with one of its keys
+func verifySigned(set *rrset, zone string, keys []*dnskey) error {
+	_, err := signatureOf(set, zone, keys)
+	return err
+}
+
+// signatureOf returns the first signature over set that zone made with one of
+// its keys and that verifies
+func signatureOf(set *rrset, zone string, keys []*dnskey) (*rrsig, error) {
+	err := fmt.Errorf("%s %s has no signatures although zone %s is signed", set.name, typeName(set.typ), zone)
+	for _, sig := range set.sigs {
+		if sig.signerName != zone {
+			err = fmt.Errorf("%s %s is signed by %s, which is not its zone %s", set.name, typeName(set.typ), sig.signerName, zone)
+			continue
+		}
+		// a signature can't claim more labels than its owner has (RFC 4035 section 5.3.1)
+		if int(sig.labels) > len(ownerLabels(set.name)) {
+			err = fmt.Errorf("the signature over %s %s claims %d labels", set.name, typeName(set.typ), sig.labels)
+			continue
+		}
+		if err = verifyRRset(set, sig, keys); err == nil {
+			return sig, nil
+		}
+	}
+	return nil, err
+}
+
+// wildcardEncloser returns the name whose wildcard set was expanded from when
+// sig counts fewer labels than the owner name, or "" when it wasn't
+func wildcardEncloser(name string, sig *rrsig) string {
+	labels := ownerLabels(name)
+	if int(sig.labels) >= len(labels) {
+		return ""
+	}
+	if sig.labels == 0 {
+		return "."
+	}
+	return strings.Join(labels[len(labels)-int(sig.labels):], ".") + "."
+}
+
+// ownerLabels are the labels an RRSIG counts for name: a leading wildcard
+// label doesn't count (RFC 4034 section 3.1.3)
+func ownerLabels(name string) []string {
+	labels := nameLabels(name)
+	if len(labels) > 0 && labels[0] == "*" {
+		return labels[1:]
+	}
+	return labels
+}
+
+// the kinds of zone cut a name can be, as its parent zone proves them
+const (
+	cutBogus    = iota // the parent's answer doesn't validate, err says why
+	cutSecure          // a delegation with DS records, keys holds the child's validated keys
+	cutInsecure        // a delegation without DS records
+	cutNone            // a name inside the parent zone
+	cutNoName          // the name doesn't exist, and neither does anything below it
+)
+
+// delegation is what the parent zone proved about a name right below it
+type delegation struct {
+	kind int
+	keys zoneKeys
+	err  error
+}
+
+// zoneFor walks the chain of trust from the root down to name and returns the
+// zone name belongs to together with that zone's keys. Every name on the way
+// is asked for its DS set, so no zone cut can be skipped or made up: a signed
+// DS set leads into a secure child zone, a proven missing DS set at a
+// delegation into an insecure one, and a proven missing DS set anywhere else
+// keeps the walk in the same zone.
+func (v *validator) zoneFor(name string) (string, zoneKeys) {
+	zone, keys := ".", v.rootKeys()
+
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	if name == "." {
+		labels = nil
+	}
+	for i := len(labels) - 1; i >= 0 && keys.status == statusSecure; i-- {
+		child := strings.Join(labels[i:], ".") + "."
+		cut := v.delegation(zone, keys, child)
+		switch cut.kind {
+		case cutSecure:
+			zone, keys = child, cut.keys
+		case cutInsecure:
+			return child, zoneKeys{status: statusInsecure}
+		case cutNoName:
+			return zone, keys
+		case cutBogus:
+			return zone, zoneKeys{status: statusBogus, err: cut.err}
+		}
+	}
+	return zone, keys
+}
+
+// delegation asks for the DS set of child, which lies right below the secure
+// zone, and checks the answer with the zone's keys. The outcome is remembered.
+func (v *validator) delegation(zone string, keys zoneKeys, child string) delegation {
+	if cut, ok := v.cuts[child]; ok {
+		return cut
+	}
+
+	cut := v.findDelegation(zone, keys, child)
+	v.cuts[child] = cut
+	return cut
+}
+
+func (v *validator) findDelegation(zone string, keys zoneKeys, child string) delegation {
+	response, err := dnsQuery(v.ctx, getRootServers(), dnssecQuestion(child, typeDS))
+	if err != nil {
+		return delegation{err: fmt.Errorf("fetching the DS records of %s: %w", child, err)}
+	}
+
+	if set := findRRset(response.Answers, child, typeDS); set != nil {
+		if err := verifySigned(set, zone, keys.keys); err != nil {
+			return delegation{err: err}
+		}
+		ds := []*dsRecord{}
+		for _, record := range set.records {
+			parsed, err := parseDS(record.Body)
+			if err != nil {
+				return delegation{err: err}
+			}
+			ds = append(ds, parsed)
+		}
+		/* a DS set we can't use at all leaves the child as unsigned as no DS set would */
+		keys := v.keysFor(child, ds)
+		if keys.status == statusInsecure {
+			return delegation{kind: cutInsecure}
+		}
+		return delegation{kind: cutSecure, keys: keys}
+	}
+
+	/* a CNAME is never a delegation, so the name is data of the zone */
+	if set := findRRset(response.Answers, child, dnsmessage.TypeCNAME); set != nil {
+		if status, err := verifyExpanded(set, zone, keys.keys, response.Authorities); status == statusBogus {
+			return delegation{err: err}
+		}
+		return delegation{kind: cutNone}
+	}
+
+	/* without DS records the zone has to prove there are none, and whether child is a delegation */
+	proof, err := proveDenial(zone, keys.keys, child, typeDS, response.Header.RCode, response.Authorities)
+	if err != nil {
+		return delegation{err: fmt.Errorf("the missing DS of %s isn't proven: %w", child, err)}
+	}
+	switch proof {
+	case proofNoName:
+		return delegation{kind: cutNoName}
+	case proofNoData:
+		return delegation{kind: cutNone}
+	}
+	return delegation{kind: cutInsecure}
+}
+
+// rootKeys returns the keys of the root zone, checked against the trust anchors
+func (v *validator) rootKeys() zoneKeys {
+	anchors, err := parseTrustAnchors(rootTrustAnchors)
+	if err != nil {
+		return zoneKeys{status: statusBogus, err: err}
+	}
+	return v.keysFor(".", anchors)
+}
+
+// keysFor returns the validated keys of zone, looking them up the first time
+func (v *validator) keysFor(zone string, ds []*dsRecord) zoneKeys {
+	if keys, ok := v.zones[zone]; ok {
+		return keys
+	}
+	keys := v.fetchKeys(zone, ds)
+	v.zones[zone] = keys
+	return keys
+}
+
+// fetchKeys finishes one step of the chain of trust: one of the keys the DS
+// records of zone point to must sign the zone's DNSKEY set. DS records with an
+// algorithm or digest type we don't support are ignored, and when none are
+// left the zone is insecure (RFC 4035 section 5.2).
+func (v *validator) fetchKeys(zone string, ds []*dsRecord) zoneKeys {
+	ds = supportedDS(ds)
+	if len(ds) == 0 {
+		return zoneKeys{status: statusInsecure}
+	}
+
+	response, err := dnsQuery(v.ctx, getRootServers(), dnssecQuestion(zone, typeDNSKEY))
+	if err != nil {
+		return zoneKeys{status: statusBogus, err: fmt.Errorf("fetching the DNSKEY records of %s: %w", zone, err)}
+	}
+	set := findRRset(response.Answers, zone, typeDNSKEY)
+	if set == nil {
+		return zoneKeys{status: statusBogus, err: fmt.Errorf("zone %s has DS records but no DNSKEY records", zone)}
+	}
+
+	keys := []*dnskey{}
+	trusted := []*dnskey{}
+	for _, record := range set.records {
+		key, err := parseDNSKEY(record.Body)
+		if err != nil {
+			return zoneKeys{status: statusBogus, err: err}
+		}
+		keys = append(keys, key)
+		if matchesDS(zone, key, ds) {
+			trusted = append(trusted, key)
+		}
+	}
+	if len(trusted) == 0 {
+		return zoneKeys{status: statusBogus, err: fmt.Errorf("no DNSKEY of %s matches its DS records", zone)}
+	}
+
+	if err := verifySigned(set, zone, trusted); err != nil {
+		return zoneKeys{status: statusBogus, err: fmt.Errorf("DNSKEY set of %s: %w", zone, err)}
+	}
+	return zoneKeys{status: statusSecure, keys: keys}
+}
+
+// supportedDS keeps the DS records whose key algorithm verifySignature knows
+// and whose digest type matchesDS knows
+func supportedDS(ds []*dsRecord) []*dsRecord {
+	supported := []*dsRecord{}
+	for _, record := range ds {
+		switch record.algorithm {
+		case 5, 7, 8, 10, 13, 14, 15:
+		default:
+			continue
+		}
+		switch record.digestType {
+		case 1, 2, 4:
+			supported = append(supported, record)
+		}
+	}
+	return supported
+}
+
+// verifyRRset checks sig over set with the first of keys it names
+func verifyRRset(set *rrset, sig *rrsig, keys []*dnskey) error {
+	now := uint32(time.Now().Unix())
+	// serial number arithmetic (RFC 1982), the timestamps wrap around in 2106
+	if int32(now-sig.inception) < 0 || int32(sig.expiration-now) < 0 {
+		return fmt.Errorf("signature over %s %s isn't valid at this time", set.name, typeName(set.typ))
+	}
+
+	data, err := signedData(set, sig)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		// only zone keys (flag bit 7) of protocol 3 may sign data (RFC 4034 section 2.1)
+		if key.flags&0x0100 == 0 || key.protocol != 3 || key.algorithm != sig.algorithm || keyTag(key.rdata) != sig.keyTag {
+			continue
+		}
+		if err = verifySignature(key, sig.signature, data); err == nil {
+			return nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no key with tag %d signs %s %s", sig.keyTag, set.name, typeName(set.typ))
+	}
+	return err
+}
+
+// signedData builds the bytes an RRSIG signs (RFC 4034 section 3.1.8.1): the
+// RRSIG rdata without the signature, followed by every record of the set in
+// canonical form and canonical order (RFC 4034 section 6)
+func signedData(set *rrset, sig *rrsig) ([]byte, error) {
+	data := append([]byte{}, sig.rdata[:18]...)
+	data = append(data, wireName(sig.signerName)...)
+
+	/* a record expanded from a wildcard is signed with the wildcard as owner */
+	owner := set.name
+	if encloser := wildcardEncloser(set.name, sig); encloser != "" {
+		owner = wildcardOf(encloser)
+	}
+	ownerWire := wireName(owner)
+
+	rdatas := [][]byte{}
+	for _, record := range set.records {
+		rdata, err := canonicalRData(record.Body)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	for i, rdata := range rdatas {
+		// duplicate records are only signed once
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		var fixed [10]byte
+		binary.BigEndian.PutUint16(fixed[0:], uint16(set.typ))
+		binary.BigEndian.PutUint16(fixed[2:], uint16(set.records[0].Header.Class))
+		binary.BigEndian.PutUint32(fixed[4:], sig.originalTTL)
+		binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+		data = append(data, ownerWire...)
+		data = append(data, fixed[:]...)
+		data = append(data, rdata...)
+	}
+	return data, nil
+}
+
+// canonicalRData encodes a record body without name compression and with the
+// names inside it in lower case (RFC 4034 section 6.2)
+func canonicalRData(body dnsmessage.ResourceBody) ([]byte, error) {
+	switch record := body.(type) {
+	case *dnsmessage.AResource:
+		return append([]byte{}, record.A[:]...), nil
+	case *dnsmessage.AAAAResource:
+		return append([]byte{}, record.AAAA[:]...), nil
+	case *dnsmessage.NSResource:
+		return wireName(record.NS.String()), nil
+	case *dnsmessage.CNAMEResource:
+		return wireName(record.CNAME.String()), nil
+	case *dnsmessage.PTRResource:
+		return wireName(record.PTR.String()), nil
+	case *dnsmessage.MXResource:
+		return append(binary.BigEndian.AppendUint16(nil, record.Pref), wireName(record.MX.String())...), nil
+	case *dnsmessage.SRVResource:
+		data := binary.BigEndian.AppendUint16(nil, record.Priority)
+		data = binary.BigEndian.AppendUint16(data, record.Weight)
+		data = binary.BigEndian.AppendUint16(data, record.Port)
+		return append(data, wireName(record.Target.String())...), nil
+	case *dnsmessage.SOAResource:
+		data := append(wireName(record.NS.String()), wireName(record.MBox.String())...)
+		for _, field := range []uint32{record.Serial, record.Refresh, record.Retry, record.Expire, record.MinTTL} {
+			data = binary.BigEndian.AppendUint32(data, field)
+		}
+		return data, nil
+	case *dnsmessage.TXTResource:
+		data := []byte{}
+		for _, text := range record.TXT {
+			data = append(data, byte(len(text)))
+			data = append(data, text...)
+		}
+		return data, nil
+	case *dnsmessage.UnknownResource:
+		// the types dnsmessage doesn't know never use compression, so their data is already canonical
+		return record.Data, nil
+	}
+	return nil, fmt.Errorf("can't build the canonical form of %T", body)
+}
+
+// wireName encodes a fully qualified name as lower case labels
+func wireName(name string) []byte {
+	data := []byte{}
+	for _, label := range strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".") {
+		if label == "" {
+			continue
+		}
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	return append(data, 0)
+}
+
+// verifySignature checks signature over data with key, for the algorithms of
+// the IANA DNSSEC registry that resolvers are expected to support (RFC 8624)
+func verifySignature(key *dnskey, signature []byte, data []byte) error {
+	switch key.algorithm {
+	case 5, 7, 8, 10: // RSASHA1, RSASHA1-NSEC3-SHA1, RSASHA256, RSASHA512
+		publicKey, err := rsaPublicKey(key.publicKey)
+		if err != nil {
+			return err
+		}
+		hashType := map[uint8]crypto.Hash{5: crypto.SHA1, 7: crypto.SHA1, 8: crypto.SHA256, 10: crypto.SHA512}[key.algorithm]
+		h := hashType.New()
+		h.Write(data)
+		return rsa.VerifyPKCS1v15(publicKey, hashType, h.Sum(nil), signature)
+
+	case 13, 14: // ECDSAP256SHA256, ECDSAP384SHA384
+		curve, h := elliptic.P256(), hash.Hash(sha256.New())
+		if key.algorithm == 14 {
+			curve, h = elliptic.P384(), sha512.New384()
+		}
+		size := curve.Params().BitSize / 8
+		if len(key.publicKey) != 2*size || len(signature) != 2*size {
+			return fmt.Errorf("ECDSA key or signature has the wrong length")
+		}
+		publicKey := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.publicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.publicKey[size:]),
+		}
+		h.Write(data)
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, h.Sum(nil), r, s) {
+			return fmt.Errorf("ECDSA signature doesn't verify")
+		}
+		return nil
+
+	case 15: // ED25519
+		if len(key.publicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("Ed25519 key has the wrong length")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.publicKey), data, signature) {
+			return fmt.Errorf("Ed25519 signature doesn't verify")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported DNSSEC algorithm %d", key.algorithm)
+}
+
+// rsaPublicKey decodes an RSA key in DNSKEY format (RFC 3110 section 2): the
+// exponent length in one byte, or in three when the first one is 0, then the
+// exponent and the modulus
+func rsaPublicKey(data []byte) (*rsa.PublicKey, error) {
+	if len(data) < 3 {
+		return nil, fmt.Errorf("RSA key is too short")
+	}
+	exponentLength, offset := int(data[0]), 1
+	if exponentLength == 0 {
+		exponentLength, offset = int(binary.BigEndian.Uint16(data[1:3])), 3
+	}
+	if len(data) <= offset+exponentLength || exponentLength > 4 {
+		return nil, fmt.Errorf("RSA key has a bad exponent")
+	}
+
+	exponent := new(big.Int).SetBytes(data[offset : offset+exponentLength])
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(data[offset+exponentLength:]),
+		E: int(exponent.Int64()),
+	}, nil
+}
+
+// keyTag computes the tag that DS and RRSIG records use to name a key (RFC 4034 appendix B)
+func keyTag(rdata []byte) uint16 {
+	var sum uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			sum += uint32(b) << 8
+		} else {
+			sum += uint32(b)
+		}
+	}
+	sum += sum >> 16 & 0xffff
+	return uint16(sum)
+}
+
+// matchesDS reports whether one of ds is the digest of key (RFC 4034 section 5.1.4)
+func matchesDS(zone string, key *dnskey, ds []*dsRecord) bool {
+	tag := keyTag(key.rdata)
+	for _, record := range ds {
+		if record.keyTag != tag || record.algorithm != key.algorithm {
+			continue
+		}
+
+		var h hash.Hash
+		switch record.digestType {
+		case 1:
+			h = sha1.New()
+		case 2:
+			h = sha256.New()
+		case 4:
+			h = sha512.New384()
+		default:
+			continue
+		}
+		h.Write(wireName(zone))
+		h.Write(key.rdata)
+		if bytes.Equal(h.Sum(nil), record.digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupRRsets sorts resources into RRsets and hands every RRSIG to the RRset
+// it covers. The order of the first appearance of each RRset is kept.
+func groupRRsets(resources []dnsmessage.Resource) []*rrset {
+	rrsets := []*rrset{}
+	byKey := map[cacheKey]*rrset{}
+	for _, resource := range resources {
+		if resource.Header.Type == typeRRSIG || resource.Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		key := newCacheKey(resource.Header.Name.String(), resource.Header.Type, resource.Header.Class)
+		set, ok := byKey[key]
+		if !ok {
+			set = &rrset{name: key.name, typ: key.typ}
+			byKey[key] = set
+			rrsets = append(rrsets, set)
+		}
+		set.records = append(set.records, resource)
+	}
+
+	for _, resource := range resources {
+		if resource.Header.Type != typeRRSIG {
+			continue
+		}
+		sig, err := parseRRSIG(resource.Body)
+		if err != nil {
+			continue
+		}
+		if set, ok := byKey[newCacheKey(resource.Header.Name.String(), sig.typeCovered, resource.Header.Class)]; ok {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+	return rrsets
+}
+
+// findRRset returns the RRset of name and typ in resources, or nil
+func findRRset(resources []dnsmessage.Resource, name string, typ dnsmessage.Type) *rrset {
+	for _, set := range groupRRsets(resources) {
+		if set.typ == typ && strings.EqualFold(set.name, name) {
+			return set
+		}
+	}
+	return nil
+}
+
+// parseDNSKEY decodes the rdata of a DNSKEY record (RFC 4034 section 2.1)
+func parseDNSKEY(body dnsmessage.ResourceBody) (*dnskey, error) {
+	record, ok := body.(*dnsmessage.UnknownResource)
+	if !ok || len(record.Data) < 5 {
+		return nil, fmt.Errorf("malformed DNSKEY record")
+	}
+	return &dnskey{
+		flags:     binary.BigEndian.Uint16(record.Data[0:2]),
+		protocol:  record.Data[2],
+		algorithm: record.Data[3],
+		publicKey: record.Data[4:],
+		rdata:     record.Data,
+	}, nil
+}
+
+// parseDS decodes the rdata of a DS record (RFC 4034 section 5.1)
+func parseDS(body dnsmessage.ResourceBody) (*dsRecord, error) {
+	record, ok := body.(*dnsmessage.UnknownResource)
+	if !ok || len(record.Data) < 5 {
+		return nil, fmt.Errorf("malformed DS record")
+	}
+	return &dsRecord{
+		keyTag:     binary.BigEndian.Uint16(record.Data[0:2]),
+		algorithm:  record.Data[2],
+		digestType: record.Data[3],
+		digest:     record.Data[4:],
+	}, nil
+}
+
+// parseRRSIG decodes the rdata of an RRSIG record (RFC 4034 section 3.1)
+func parseRRSIG(body dnsmessage.ResourceBody) (*rrsig, error) {
+	record, ok := body.(*dnsmessage.UnknownResource)
+	if !ok || len(record.Data) < 19 {
+		return nil, fmt.Errorf("malformed RRSIG record")
+	}
+	data := record.Data
+	signerName, offset, err := readWireName(data, 18)
+	if err != nil {
+		return nil, fmt.Errorf("malformed RRSIG signer name")
+	}
+
+	return &rrsig{
+		typeCovered: dnsmessage.Type(binary.BigEndian.Uint16(data[0:2])),
+		algorithm:   data[2],
+		labels:      data[3],
+		originalTTL: binary.BigEndian.Uint32(data[4:8]),
+		expiration:  binary.BigEndian.Uint32(data[8:12]),
+		inception:   binary.BigEndian.Uint32(data[12:16]),
+		keyTag:      binary.BigEndian.Uint16(data[16:18]),
+		signerName:  signerName,
+		signature:   data[offset:],
+		rdata:       data,
+	}, nil
+}
+
+// readWireName reads an uncompressed name starting at offset in data, as the
+// DNSSEC records carry them, and returns it in lower case with the offset
+// right after it
+func readWireName(data []byte, offset int) (string, int, error) {
+	labels := []string{}
+	for {
+		if offset >= len(data) {
+			return "", 0, fmt.Errorf("name runs past the end of the record")
+		}
+		length := int(data[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length > 63 || offset+length > len(data) {
+			return "", 0, fmt.Errorf("malformed label in name")
+		}
+		labels = append(labels, string(data[offset:offset+length]))
+		offset += length
+	}
+	return strings.ToLower(strings.Join(labels, ".") + "."), offset, nil
+}
+
+// coveredType returns the type an RRSIG record signs, or 0 for anything else
+func coveredType(resource dnsmessage.Resource) dnsmessage.Type {
+	record, ok := resource.Body.(*dnsmessage.UnknownResource)
+	if resource.Header.Type != typeRRSIG || !ok || len(record.Data) < 2 {
+		return 0
+	}
+	return dnsmessage.Type(binary.BigEndian.Uint16(record.Data[0:2]))
+}
+
+// parseTrustAnchors decodes DS records written as "key tag, algorithm, digest type, hex digest"
+func parseTrustAnchors(anchors []string) ([]*dsRecord, error) {
+	ds := []*dsRecord{}
+	for _, anchor := range anchors {
+		fields := strings.Fields(anchor)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("trust anchor %q must have 4 fields", anchor)
+		}
+		tag, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("trust anchor %q: %w", anchor, err)
+		}
+		algorithm, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("trust anchor %q: %w", anchor, err)
+		}
+		digestType, err := strconv.ParseUint(fields[2], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("trust anchor %q: %w", anchor, err)
+		}
+		digest, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("trust anchor %q: %w", anchor, err)
+		}
+		ds = append(ds, &dsRecord{keyTag: uint16(tag), algorithm: uint8(algorithm), digestType: uint8(digestType), digest: digest})
+	}
+	return ds, nil
+}
+
+// dnssecQuestion builds a question the validator asks for itself
+func dnssecQuestion(name string, typ dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}
+}
+
+// weaker reports whether status a is weaker than b, bogus being the weakest
+func weaker(a, b string) bool {
+	rank := map[string]int{statusBogus: 0, statusInsecure: 1, statusSecure: 2}
+	return rank[a] < rank[b]
+}
+
+// typeName prints a record type, also the DNSSEC ones dnsmessage doesn't know
+func typeName(typ dnsmessage.Type) string {
+	switch typ {
+	case typeDS:
+		return "DS"
+	case typeRRSIG:
+		return "RRSIG"
+	case typeNSEC:
+		return "NSEC"
+	case typeDNSKEY:
+		return "DNSKEY"
+	case typeNSEC3:
+		return "NSEC3"
+	case typeCAA:
+		return "CAA"
+	}
+	return strings.TrimPrefix(typ.String(), "Type")
+}
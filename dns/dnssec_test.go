@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// the NSEC3 parameters of the test zones that use NSEC3
+var (
+	testNSEC3Salt       = []byte{0xab, 0xcd}
+	testNSEC3Iterations = uint16(2)
+)
+
+// testZone is a zone signed in the test with one ECDSA P-256 key (algorithm
+// 13). It answers like an authoritative server: signed RRsets, referrals to
+// the zones below it, and the NSEC or NSEC3 records proving what doesn't exist.
+type testZone struct {
+	t       *testing.T
+	name    string
+	key     *ecdsa.PrivateKey
+	dnskey  []byte
+	nsec3   bool
+	records []dnsmessage.Resource
+}
+
+func newTestZone(t *testing.T, name string, nsec3 bool) *testZone {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := make([]byte, 64)
+	key.X.FillBytes(publicKey[:32])
+	key.Y.FillBytes(publicKey[32:])
+
+	// flags 257: a zone key that is also a secure entry point
+	z := &testZone{t: t, name: name, key: key, dnskey: append([]byte{1, 1, 3, 13}, publicKey...), nsec3: nsec3}
+	z.add(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body: &dnsmessage.SOAResource{
+			NS: dnsmessage.MustNewName("ns.test."), MBox: dnsmessage.MustNewName("hostmaster.test."),
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 60,
+		},
+	}, fakeNS(name, "ns.test."), dnssecRecord(name, typeDNSKEY, z.dnskey))
+	return z
+}
+
+// dnssecRecord is a record of one of the types dnsmessage only knows as UnknownResource
+func dnssecRecord(name string, typ dnsmessage.Type, rdata []byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.UnknownResource{Type: typ, Data: rdata},
+	}
+}
+
+func (z *testZone) add(records ...dnsmessage.Resource) {
+	z.records = append(z.records, records...)
+}
+
+// delegate adds child to z, served by ns.<child> at 10.0.0.<ip>, with child's
+// DS record when it is signed
+func (z *testZone) delegate(child string, ip byte, signed *testZone) {
+	z.add(fakeNS(child, "ns."+child), fakeA("ns."+child, 10, 0, 0, ip))
+	if signed != nil {
+		z.add(signed.ds())
+	}
+}
+
+// ds is the DS record of z with a SHA-256 digest, as its parent publishes it
+func (z *testZone) ds() dnsmessage.Resource {
+	digest := sha256.Sum256(append(wireName(z.name), z.dnskey...))
+	rdata := binary.BigEndian.AppendUint16(nil, keyTag(z.dnskey))
+	rdata = append(rdata, 13, 2)
+	return dnssecRecord(z.name, typeDS, append(rdata, digest[:]...))
+}
+
+// anchor is the DS record of z in the form of rootTrustAnchors
+func (z *testZone) anchor() string {
+	digest := sha256.Sum256(append(wireName(z.name), z.dnskey...))
+	return fmt.Sprintf("%d 13 2 %X", keyTag(z.dnskey), digest)
+}
+
+// sign makes the RRSIG of z over set, which holds the records of one name and type
+func (z *testZone) sign(set []dnsmessage.Resource) dnsmessage.Resource {
+	owner, typ, ttl := set[0].Header.Name.String(), set[0].Header.Type, set[0].Header.TTL
+	now := uint32(time.Now().Unix())
+	rdata := binary.BigEndian.AppendUint16(nil, uint16(typ))
+	rdata = append(rdata, 13, byte(len(ownerLabels(owner))))
+	rdata = binary.BigEndian.AppendUint32(rdata, ttl)
+	rdata = binary.BigEndian.AppendUint32(rdata, now+3600)
+	rdata = binary.BigEndian.AppendUint32(rdata, now-3600)
+	rdata = binary.BigEndian.AppendUint16(rdata, keyTag(z.dnskey))
+	rdata = append(rdata, wireName(z.name)...)
+
+	data, err := signedData(&rrset{name: owner, typ: typ, records: set}, &rrsig{labels: rdata[3], originalTTL: ttl, signerName: z.name, rdata: rdata})
+	if err != nil {
+		z.t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, z.key, digest[:])
+	if err != nil {
+		z.t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return dnssecRecord(owner, typeRRSIG, append(rdata, signature...))
+}
+
+// signed returns set followed by the RRSIG of z over it
+func (z *testZone) signed(set []dnsmessage.Resource) []dnsmessage.Resource {
+	return append(append([]dnsmessage.Resource{}, set...), z.sign(set))
+}
+
+// rrset returns the records of name and typ
+func (z *testZone) rrset(name string, typ dnsmessage.Type) []dnsmessage.Resource {
+	set := []dnsmessage.Resource{}
+	for _, record := range z.records {
+		if strings.EqualFold(record.Header.Name.String(), name) && record.Header.Type == typ {
+			set = append(set, record)
+		}
+	}
+	return set
+}
+
+// cut returns the delegation name is at or below, or ""
+func (z *testZone) cut(name string) string {
+	for _, record := range z.records {
+		owner := strings.ToLower(record.Header.Name.String())
+		if record.Header.Type == dnsmessage.TypeNS && owner != z.name && isSubdomain(name, owner) {
+			return owner
+		}
+	}
+	return ""
+}
+
+// names returns the names of z in canonical order, delegations included but
+// not the glue below them. With ents, the empty non-terminals are included too.
+func (z *testZone) names(ents bool) []string {
+	seen := map[string]bool{}
+	for _, record := range z.records {
+		name := strings.ToLower(record.Header.Name.String())
+		if cut := z.cut(name); cut != "" && cut != name {
+			continue
+		}
+		seen[name] = true
+		for ents && name != z.name {
+			name = parentZone(name)
+			seen[name] = true
+		}
+	}
+	names := []string{}
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalCompare(names[i], names[j]) < 0 })
+	return names
+}
+
+func (z *testZone) exists(name string) bool {
+	return contains(z.names(true), name)
+}
+
+func contains(names []string, name string) bool {
+	for _, existing := range names {
+		if existing == name {
+			return true
+		}
+	}
+	return false
+}
+
+// typeBitmap lists the types at name the way the NSEC or NSEC3 record of name does
+func (z *testZone) typeBitmap(name string) []byte {
+	types := map[dnsmessage.Type]bool{}
+	for _, record := range z.records {
+		if strings.EqualFold(record.Header.Name.String(), name) {
+			types[record.Header.Type] = true
+		}
+	}
+	if !z.nsec3 {
+		types[typeNSEC] = true
+	}
+	if len(types) > 0 {
+		types[typeRRSIG] = true
+	}
+
+	windows := map[byte][]byte{}
+	for typ := range types {
+		window, bit := byte(typ>>8), byte(typ)
+		bits := windows[window]
+		for len(bits) <= int(bit/8) {
+			bits = append(bits, 0)
+		}
+		bits[bit/8] |= 0x80 >> (bit % 8)
+		windows[window] = bits
+	}
+	bitmap := []byte{}
+	for window := 0; window < 256; window++ {
+		if bits, ok := windows[byte(window)]; ok {
+			bitmap = append(append(bitmap, byte(window), byte(len(bits))), bits...)
+		}
+	}
+	return bitmap
+}
+
+// chain returns the NSEC or NSEC3 records of z in their order, together with
+// what each one starts at: an owner name, or an owner hash for NSEC3
+func (z *testZone) chain() ([]dnsmessage.Resource, []string) {
+	records, starts := []dnsmessage.Resource{}, []string{}
+	if !z.nsec3 {
+		names := z.names(false)
+		for i, name := range names {
+			next := names[(i+1)%len(names)]
+			records = append(records, dnssecRecord(name, typeNSEC, append(wireName(next), z.typeBitmap(name)...)))
+			starts = append(starts, name)
+		}
+		return records, starts
+	}
+
+	hashes := map[string]string{}
+	for _, name := range z.names(true) {
+		hash := string(nsec3Hash(name, testNSEC3Salt, testNSEC3Iterations))
+		hashes[hash] = name
+		starts = append(starts, hash)
+	}
+	sort.Strings(starts)
+	encoding := base32.HexEncoding.WithPadding(base32.NoPadding)
+	for i, hash := range starts {
+		rdata := []byte{1, 0}
+		rdata = binary.BigEndian.AppendUint16(rdata, testNSEC3Iterations)
+		rdata = append(append(rdata, byte(len(testNSEC3Salt))), testNSEC3Salt...)
+		rdata = append(append(rdata, 20), starts[(i+1)%len(starts)]...)
+		rdata = append(rdata, z.typeBitmap(hashes[hash])...)
+		owner := strings.ToLower(encoding.EncodeToString([]byte(hash))) + "." + z.name
+		records = append(records, dnssecRecord(owner, typeNSEC3, rdata))
+	}
+	return records, starts
+}
+
+// matching returns the signed NSEC or NSEC3 record of name
+func (z *testZone) matching(name string) []dnsmessage.Resource {
+	records, starts := z.chain()
+	key := name
+	if z.nsec3 {
+		key = string(nsec3Hash(name, testNSEC3Salt, testNSEC3Iterations))
+	}
+	for i, start := range starts {
+		if start == key {
+			return z.signed(records[i : i+1])
+		}
+	}
+	z.t.Fatalf("%s has no NSEC of its own in %s", name, z.name)
+	return nil
+}
+
+// covering returns the signed NSEC or NSEC3 record whose span holds name
+func (z *testZone) covering(name string) []dnsmessage.Resource {
+	records, starts := z.chain()
+	key, less := name, func(a, b string) bool { return canonicalCompare(a, b) < 0 }
+	if z.nsec3 {
+		key, less = string(nsec3Hash(name, testNSEC3Salt, testNSEC3Iterations)), func(a, b string) bool { return a < b }
+	}
+	/* the last record wraps around to the first, so it covers whatever sorts before the first too */
+	covering := len(starts) - 1
+	for i, start := range starts {
+		if less(start, key) {
+			covering = i
+		}
+	}
+	return z.signed(records[covering : covering+1])
+}
+
+// answer fills in the reply of z's server to question
+func (z *testZone) answer(question dnsmessage.Question, reply *dnsmessage.Message) {
+	name, typ := strings.ToLower(question.Name.String()), question.Type
+
+	/* at and below a delegation the parent only refers, except for the DS set it holds itself */
+	if cut := z.cut(name); cut != "" && (cut != name || typ != typeDS) {
+		reply.Authorities = z.rrset(cut, dnsmessage.TypeNS)
+		if ds := z.rrset(cut, typeDS); len(ds) > 0 {
+			reply.Authorities = append(reply.Authorities, z.signed(ds)...)
+		}
+		reply.Additionals = z.rrset("ns."+cut, dnsmessage.TypeA)
+		return
+	}
+
+	reply.Header.Authoritative = true
+	soa := z.signed(z.rrset(z.name, dnsmessage.TypeSOA))
+	if z.exists(name) {
+		if records := z.rrset(name, typ); len(records) > 0 {
+			reply.Answers = z.signed(records)
+			return
+		}
+		/* in an NSEC chain an empty non-terminal is proven by the record before it */
+		proof := z.covering(name)
+		if z.nsec3 || contains(z.names(false), name) {
+			proof = z.matching(name)
+		}
+		reply.Authorities = append(soa, proof...)
+		return
+	}
+
+	encloser := parentZone(name)
+	nextCloser := name
+	for !z.exists(encloser) {
+		encloser, nextCloser = parentZone(encloser), encloser
+	}
+	wildcard := wildcardOf(encloser)
+
+	/* the proof that the name doesn't exist: with NSEC a span covering it, with NSEC3 the closest encloser */
+	proof := z.covering(name)
+	if z.nsec3 {
+		proof = append(z.matching(encloser), z.covering(nextCloser)...)
+	}
+	switch {
+	case z.exists(wildcard) && len(z.rrset(wildcard, typ)) > 0:
+		reply.Answers = z.signed(z.rrset(wildcard, typ))
+		for i := range reply.Answers {
+			reply.Answers[i].Header.Name = question.Name
+		}
+		if z.nsec3 {
+			proof = z.covering(nextCloser)
+		}
+		reply.Authorities = proof
+	case z.exists(wildcard):
+		reply.Authorities = append(append(soa, proof...), z.matching(wildcard)...)
+	default:
+		reply.Header.RCode = dnsmessage.RCodeNameError
+		reply.Authorities = append(append(soa, proof...), z.covering(wildcard)...)
+	}
+}
+
+// useSignedHierarchy serves a signed root at 10.0.0.1 with these zones below it:
+//
+//	example.   10.0.0.2, signed with NSEC, has www, a wildcard below wild, and
+//	           stripped, wrongsigner and replay.wild, whose answers are tampered with
+//	example3.  10.0.0.3, signed with NSEC3, has www and a wildcard below wild
+//	insecure.  10.0.0.4, not signed and without a DS record
+//	ed448.     10.0.0.5, its DS record is for Ed448 keys, which aren't supported
+func useSignedHierarchy(t *testing.T) {
+	root := newTestZone(t, ".", false)
+	example := newTestZone(t, "example.", false)
+	example3 := newTestZone(t, "example3.", true)
+
+	example.add(fakeA("ns.example.", 10, 0, 0, 2), fakeA("www.example.", 192, 0, 2, 1), fakeA("*.wild.example.", 192, 0, 2, 2),
+		fakeA("stripped.example.", 192, 0, 2, 3), fakeA("wrongsigner.example.", 192, 0, 2, 4))
+	example3.add(fakeA("ns.example3.", 10, 0, 0, 3), fakeA("www.example3.", 192, 0, 2, 5), fakeA("*.wild.example3.", 192, 0, 2, 6))
+	root.delegate("example.", 2, example)
+	root.delegate("example3.", 3, example3)
+	root.delegate("insecure.", 4, nil)
+	root.delegate("ed448.", 5, nil)
+	root.add(dnssecRecord("ed448.", typeDS, append([]byte{0x30, 0x39, 16, 2}, make([]byte, 32)...)))
+
+	useUpstream(t, fakeServer(func(address string, question dnsmessage.Question, reply *dnsmessage.Message) {
+		switch address {
+		case "10.0.0.1:53":
+			root.answer(question, reply)
+		case "10.0.0.2:53":
+			example.answer(question, reply)
+			if question.Type != dnsmessage.TypeA {
+				return
+			}
+			switch strings.ToLower(question.Name.String()) {
+			case "stripped.example.":
+				reply.Answers = withoutSignatures(reply.Answers)
+			case "wrongsigner.example.":
+				reply.Answers = append(withoutSignatures(reply.Answers), root.sign(withoutSignatures(reply.Answers)))
+			case "replay.wild.example.":
+				reply.Authorities = nil
+			}
+		case "10.0.0.3:53":
+			example3.answer(question, reply)
+		case "10.0.0.4:53", "10.0.0.5:53":
+			reply.Header.Authoritative = true
+			reply.Answers = []dnsmessage.Resource{fakeA(question.Name.String(), 192, 0, 2, 7)}
+		default:
+			t.Errorf("query to unknown server %s", address)
+			reply.Header.RCode = dnsmessage.RCodeRefused
+		}
+	}))
+
+	oldEnabled, oldAnchors := dnssecEnabled, rootTrustAnchors
+	t.Cleanup(func() { dnssecEnabled, rootTrustAnchors = oldEnabled, oldAnchors })
+	dnssecEnabled = true
+	rootTrustAnchors = []string{root.anchor()}
+}
+
+func TestValidateSignedZones(t *testing.T) {
+	tests := []struct {
+		name   string
+		typ    dnsmessage.Type
+		rcode  dnsmessage.RCode
+		status string
+		err    string // part of the error of a bogus answer
+	}{
+		{"www.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, statusSecure, ""},
+		{"missing.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, statusSecure, ""},
+		{"www.example.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, statusSecure, ""},
+		{"host.wild.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, statusSecure, ""},
+		{"stripped.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, statusBogus, "no signatures"},
+		{"wrongsigner.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, statusBogus, "signed by ."},
+		{"replay.wild.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, statusBogus, "wildcard"},
+		{"www.example3.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, statusSecure, ""},
+		{"missing.example3.", dnsmessage.TypeA, dnsmessage.RCodeNameError, statusSecure, ""},
+		{"www.example3.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, statusSecure, ""},
+		{"host.wild.example3.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, statusSecure, ""},
+		{"www.insecure.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, statusInsecure, ""},
+		{"www.ed448.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, statusInsecure, ""},
+	}
+	for _, test := range tests {
+		useSignedHierarchy(t)
+		question := dnsmessage.Question{Name: dnsmessage.MustNewName(test.name), Type: test.typ, Class: dnsmessage.ClassINET}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		response, err := lookup(ctx, question)
+		if err != nil {
+			cancel()
+			t.Fatalf("%s %s: %v", test.name, typeName(test.typ), err)
+		}
+		if response.Header.RCode != test.rcode {
+			t.Errorf("%s %s: rcode %s, want %s", test.name, typeName(test.typ), rcodeName(response.Header.RCode), rcodeName(test.rcode))
+		}
+
+		status, err := validateResponse(ctx, question, response)
+		cancel()
+		if status != test.status {
+			t.Errorf("%s %s: %s (%v), want %s", test.name, typeName(test.typ), status, err, test.status)
+			continue
+		}
+		if test.status == statusBogus && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s %s: bogus because of %v, want an error about %q", test.name, typeName(test.typ), err, test.err)
+		}
+	}
+}
+
+func TestValidateCachedWildcardKeepsItsProof(t *testing.T) {
+	useSignedHierarchy(t)
+
+	/* the second lookup is answered from the cache, the NSEC proving the expansion has to come along */
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("host.wild.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	for i := 0; i < 2; i++ {
+		response, err := lookup(context.Background(), question)
+		if err != nil {
+			t.Fatalf("lookup %d: %v", i+1, err)
+		}
+		if status, err := validateResponse(context.Background(), question, response); status != statusSecure {
+			t.Fatalf("lookup %d: %s (%v), want secure", i+1, status, err)
+		}
+	}
+}
+
+func TestKeyTagAndDSDigest(t *testing.T) {
+	/* the example of RFC 4034 section 5.4 */
+	publicKey, err := base64.StdEncoding.DecodeString("AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMmmAphXdvxegXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9XzcnOf+EPbtG9DMBmADjFDc2w/rljwvFw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parseDNSKEY(&dnsmessage.UnknownResource{Type: typeDNSKEY, Data: append([]byte{1, 0, 3, 5}, publicKey...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag := keyTag(key.rdata); tag != 60485 {
+		t.Errorf("key tag %d, want 60485", tag)
+	}
+
+	digest, _ := hex.DecodeString("2BB183AF5F22588179A53B0A98631FAD1A292118")
+	ds := []*dsRecord{{keyTag: 60485, algorithm: 5, digestType: 1, digest: digest}}
+	if !matchesDS("dskey.example.com.", key, ds) {
+		t.Errorf("the key doesn't match its DS record")
+	}
+	if matchesDS("other.example.com.", key, ds) {
+		t.Errorf("the key matches the DS record of another zone")
+	}
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	/* from the example zone of RFC 5155 appendix A, salt aabbccdd and 12 iterations */
+	tests := map[string]string{
+		"example.":     "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example.":   "35mthgpgcu1qg68fab165klnsnk3dpvl",
+		"ns1.example.": "2t7b4g4vsa5smi47k61mv5bv1a22bojr",
+		"w.example.":   "k8udemvp1j2f7eg6jebps17vp3n8i58h",
+		"*.w.example.": "r53bq7cc2uvmubfu5ocmm6pers9tk9en",
+	}
+	encoding := base32.HexEncoding.WithPadding(base32.NoPadding)
+	for name, want := range tests {
+		if got := strings.ToLower(encoding.EncodeToString(nsec3Hash(name, []byte{0xaa, 0xbb, 0xcc, 0xdd}, 12))); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// dohContentType is the media type of a DNS message in DNS over HTTPS (RFC 8484 section 6)
+const dohContentType = "application/dns-message"
+
+// dohUseGET is set with -doh-method GET. GET requests can be cached by HTTP
+// caches on the way, POST requests are smaller.
+var dohUseGET = false
+
+// dohTransport is DNS over HTTPS (RFC 8484). The HTTP client keeps its
+// connections open, and uses HTTP/2 when the server offers it, so queries
+// share connections instead of each doing a TLS handshake.
+type dohTransport struct {
+	client *http.Client
+}
+
+// newDoHTransport sets up DNS over HTTPS, verifying certificates against the
+// system roots or -tls-ca
+func newDoHTransport() *dohTransport {
+	return &dohTransport{client: &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     &tls.Config{RootCAs: tlsRootCAs, MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+	}}}
+}
+
+// Exchange sends query to the URL address, in the body of a POST or as the
+// base64url dns parameter of a GET (RFC 8484 section 4.1), and returns the
+// DNS message in the body of the reply
+func (t *dohTransport) Exchange(ctx context.Context, address string, query []byte, bufferSize int) ([]byte, error) {
+	ctx, cancel := context.WithDeadline(ctx, attemptDeadline(ctx))
+	defer cancel()
+
+	var request *http.Request
+	var err error
+	if dohUseGET {
+		separator := "?"
+		if strings.Contains(address, "?") {
+			separator = "&"
+		}
+		request, err = http.NewRequestWithContext(ctx, http.MethodGet, address+separator+"dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	} else {
+		request, err = http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(query))
+		if err == nil {
+			request.Header.Set("Content-Type", dohContentType)
+			/* a query can safely be sent twice, so let the client retry it when the server
+			   closed an idle connection. A nil value marks it without sending the header */
+			request.Header["Idempotency-Key"] = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", dohContentType)
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %s", response.Status)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != dohContentType {
+		return nil, fmt.Errorf("unexpected content type %q", contentType)
+	}
+
+	/* a DNS message can't be bigger than 65535 bytes, whatever the server sends */
+	answer, err := io.ReadAll(io.LimitReader(response.Body, maxTCPResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) > maxTCPResponseSize {
+		return nil, fmt.Errorf("response is bigger than a DNS message can be")
+	}
+	return answer, nil
+}
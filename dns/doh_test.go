@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startDoHServer is a stand-in DNS over HTTPS server answering GET and POST
+// at /dns-query. It counts the connections it gets and fails the test when a
+// request isn't made the way RFC 8484 says.
+func startDoHServer(t *testing.T, method string) (*httptest.Server, *int32, *int32) {
+	t.Helper()
+	var connections, requests int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Method != method || r.URL.Path != "/dns-query" || r.Header.Get("Accept") != dohContentType {
+			t.Errorf("got %s %s with Accept %q, want %s /dns-query", r.Method, r.URL.Path, r.Header.Get("Accept"), method)
+		}
+
+		var query []byte
+		var err error
+		if r.Method == http.MethodGet {
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			if r.Header.Get("Content-Type") != dohContentType {
+				t.Errorf("POST with content type %q", r.Header.Get("Content-Type"))
+			}
+			query, err = io.ReadAll(r.Body)
+		}
+		if err != nil || len(query) < 12 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(echoAnswer(query))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, &connections, &requests
+}
+
+// x509PoolOf trusts the certificate of an httptest TLS server
+func x509PoolOf(server *httptest.Server) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return pool
+}
+
+// useDoHMethod sets dohUseGET, like -doh-method, for the rest of the test
+func useDoHMethod(t *testing.T, method string) {
+	old := dohUseGET
+	t.Cleanup(func() { dohUseGET = old })
+	dohUseGET = method == http.MethodGet
+}
+
+func TestDoHReusesConnection(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			server, connections, requests := startDoHServer(t, method)
+			useDoHMethod(t, method)
+			useRootCAs(t, x509PoolOf(server))
+
+			exchangeTwice(t, newDoHTransport(), server.URL+"/dns-query")
+			if got := atomic.LoadInt32(requests); got != 2 {
+				t.Errorf("server got %d requests, want 2", got)
+			}
+			if got := atomic.LoadInt32(connections); got != 1 {
+				t.Errorf("two queries took %d connections, want 1", got)
+			}
+		})
+	}
+}
+
+func TestDoHRetriesClosedIdleConnection(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			server, connections, _ := startDoHServer(t, method)
+			useDoHMethod(t, method)
+			useRootCAs(t, x509PoolOf(server))
+
+			transport := newDoHTransport()
+			exchangeTwice(t, transport, server.URL+"/dns-query")
+			server.CloseClientConnections()
+			exchangeTwice(t, transport, server.URL+"/dns-query")
+			if got := atomic.LoadInt32(connections); got != 2 {
+				t.Errorf("queries before and after the server hung up took %d connections, want 2", got)
+			}
+		})
+	}
+}
+
+func TestDoHRejectsUntrustedCertificate(t *testing.T) {
+	server, _, requests := startDoHServer(t, http.MethodPost)
+	useDoHMethod(t, http.MethodPost)
+	useRootCAs(t, nil)
+
+	query := testMessage(t, 1, false, testQuestion(t, "www.example.org."), [4]byte{})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := newDoHTransport().Exchange(ctx, server.URL+"/dns-query", query, 512); err == nil {
+		t.Fatal("the test server's certificate was accepted without -tls-ca")
+	}
+	if got := atomic.LoadInt32(requests); got != 0 {
+		t.Errorf("the query reached the server %d times over an untrusted connection", got)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohPath is where DNS over HTTPS queries are answered. RFC 8484 leaves the
+// path to the server, /dns-query is what clients expect by default.
+const dohPath = "/dns-query"
+
+// serveDoH runs the recursive resolver as a DNS over HTTPS endpoint on
+// address. With certFile and keyFile it speaks HTTPS, without them plain
+// HTTP, for running behind a proxy that takes care of TLS.
+func serveDoH(address, certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, handleDoH)
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: tcpIdleTimeout,
+		IdleTimeout:       tcpIdleTimeout,
+	}
+
+	if certFile != "" {
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// handleDoH answers one DNS over HTTPS request (RFC 8484 section 4.1): a GET
+// with the query base64url encoded in the dns parameter, or a POST with the
+// query as body. Both are answered with the DNS message handleQuery builds.
+func handleDoH(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		encoded := r.URL.Query().Get("dns")
+		if encoded == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		// the padding is left out, but accept it from clients that send it anyway
+		if query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "=")); err != nil {
+			http.Error(w, "dns parameter isn't base64url", http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "content type must be "+dohContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		if query, err = io.ReadAll(io.LimitReader(r.Body, maxTCPResponseSize+1)); err != nil {
+			http.Error(w, "reading the query failed", http.StatusBadRequest)
+			return
+		}
+		if len(query) > maxTCPResponseSize {
+			http.Error(w, "query is bigger than a DNS message can be", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	/* HTTP has no datagram limit, so the response can be as big as over TCP */
+	response, err := handleQuery(query, maxTCPResponseSize)
+	if err != nil {
+		log.Printf("dropping DNS over HTTPS query from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "malformed DNS query", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge(response)))
+	w.Write(response)
+}
+
+// maxAge is how long HTTP caches may keep a response: the smallest TTL of its
+// records (RFC 8484 section 5.1), and 0 for a response without any
+func maxAge(response []byte) uint32 {
+	var p dnsmessage.Parser
+	if _, err := p.Start(response); err != nil {
+		return 0
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return 0
+	}
+	authorities, err := p.AllAuthorities()
+	if err != nil {
+		return 0
+	}
+
+	records := append(answers, authorities...)
+	if len(records) == 0 {
+		return 0
+	}
+	age := records[0].Header.TTL
+	for _, record := range records[1:] {
+		if record.Header.TTL < age {
+			age = record.Header.TTL
+		}
+	}
+	return age
+}
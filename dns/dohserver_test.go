@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDoHRequest runs handleDoH on one request and returns the recorded reply
+func serveDoHRequest(method, target, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, body)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	recorder := httptest.NewRecorder()
+	handleDoH(recorder, request)
+	return recorder
+}
+
+func TestHandleDoHGet(t *testing.T) {
+	useFakeHierarchy(t)
+	query := clientQuery(t, 0, []dnsmessage.Question{testQuestion(t, "www.site.test.")}, 0)
+
+	/* RFC 8484 leaves out the padding, some clients send it anyway */
+	for _, encoded := range []string{base64.RawURLEncoding.EncodeToString(query), base64.URLEncoding.EncodeToString(query)} {
+		recorder := serveDoHRequest(http.MethodGet, dohPath+"?dns="+encoded, "", nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("dns=%s: status %d, want 200: %s", encoded, recorder.Code, recorder.Body)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); contentType != dohContentType {
+			t.Errorf("dns=%s: content type %q, want %s", encoded, contentType, dohContentType)
+		}
+		response := unpackResponse(t, recorder.Body.Bytes())
+		if got := strings.Join(answerStrings(response.Answers), "; "); got != "www.site.test. A 192.0.2.10" {
+			t.Errorf("dns=%s: answers %q", encoded, got)
+		}
+	}
+}
+
+func TestHandleDoHPost(t *testing.T) {
+	useFakeHierarchy(t)
+	query := clientQuery(t, 0, []dnsmessage.Question{testQuestion(t, "www.site.test.")}, 0)
+
+	recorder := serveDoHRequest(http.MethodPost, dohPath, dohContentType, bytes.NewReader(query))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+	if got := strings.Join(answerStrings(unpackResponse(t, recorder.Body.Bytes()).Answers), "; "); got != "www.site.test. A 192.0.2.10" {
+		t.Errorf("answers %q", got)
+	}
+}
+
+func TestHandleDoHBadRequests(t *testing.T) {
+	useFakeHierarchy(t)
+	query := clientQuery(t, 0, []dnsmessage.Question{testQuestion(t, "www.site.test.")}, 0)
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"POST without the DNS content type", http.MethodPost, dohPath, "application/json", query, http.StatusUnsupportedMediaType},
+		{"POST without a content type", http.MethodPost, dohPath, "", query, http.StatusUnsupportedMediaType},
+		{"POST bigger than a DNS message", http.MethodPost, dohPath, dohContentType, make([]byte, maxTCPResponseSize+1), http.StatusRequestEntityTooLarge},
+		{"POST that isn't a DNS message", http.MethodPost, dohPath, dohContentType, []byte("hello"), http.StatusBadRequest},
+		{"GET without the dns parameter", http.MethodGet, dohPath, "", nil, http.StatusBadRequest},
+		{"GET with standard base64", http.MethodGet, dohPath + "?dns=" + strings.Repeat("+/", 8), "", nil, http.StatusBadRequest},
+		{"PUT", http.MethodPut, dohPath, dohContentType, query, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		recorder := serveDoHRequest(test.method, test.target, test.contentType, bytes.NewReader(test.body))
+		if recorder.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+}
+
+func TestHandleDoHMaxAge(t *testing.T) {
+	/* the CNAME and its target come with different TTLs, the smallest one counts */
+	useUpstream(t, fakeServer(func(address string, question dnsmessage.Question, reply *dnsmessage.Message) {
+		reply.Header.Authoritative = true
+		switch strings.ToLower(question.Name.String()) {
+		case "alias.site.test.":
+			target := fakeA("www.site.test.", 192, 0, 2, 10)
+			target.Header.TTL = 45
+			reply.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("www.site.test.")},
+			}, target}
+		default:
+			reply.Header.RCode = dnsmessage.RCodeNameError
+		}
+	}))
+
+	tests := []struct {
+		name   string
+		maxAge string
+	}{
+		{"alias.site.test.", "max-age=45"},
+		// no records at all, so nothing says how long the answer holds
+		{"missing.site.test.", "max-age=0"},
+	}
+	for _, test := range tests {
+		query := clientQuery(t, 0, []dnsmessage.Question{testQuestion(t, test.name)}, 0)
+		recorder := serveDoHRequest(http.MethodPost, dohPath, dohContentType, bytes.NewReader(query))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200", test.name, recorder.Code)
+		}
+		if got := recorder.Header().Get("Cache-Control"); got != test.maxAge {
+			t.Errorf("%s: Cache-Control %q, want %q", test.name, got, test.maxAge)
+		}
+	}
+}
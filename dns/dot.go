@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// maxIdleConns is how many open connections a DNS over TLS forwarder keeps around for the next queries
+const maxIdleConns = 4
+
+// dotTransport is DNS over TLS (RFC 7858) to one forwarder. Messages carry
+// the same 2 byte length prefix as over TCP. Connections stay open between
+// queries and are reused, which saves a TCP and a TLS handshake per query.
+type dotTransport struct {
+	config *tls.Config
+	idle   chan *tls.Conn // connections waiting for the next query
+}
+
+// newDoTTransport sets up DNS over TLS. The server's certificate has to be
+// valid for serverName, which may also be an IP address.
+func newDoTTransport(serverName string) *dotTransport {
+	return &dotTransport{
+		config: &tls.Config{ServerName: serverName, RootCAs: tlsRootCAs, MinVersion: tls.VersionTLS12},
+		idle:   make(chan *tls.Conn, maxIdleConns),
+	}
+}
+
+// Exchange sends query over an idle connection, or a new one when there is
+// none. A server may close connections that sat idle for a while, so when a
+// reused connection fails the query gets one more try on a fresh connection.
+func (t *dotTransport) Exchange(ctx context.Context, address string, query []byte, bufferSize int) ([]byte, error) {
+	for {
+		conn, reused, err := t.conn(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(attemptDeadline(ctx))
+
+		var answer []byte
+		if err = writeTCPMessage(conn, query); err == nil {
+			if answer, err = readTCPMessage(conn); err == nil {
+				t.release(conn)
+				return answer, nil
+			}
+		}
+		conn.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// conn takes an idle connection, or dials a new one and does the TLS handshake
+func (t *dotTransport) conn(ctx context.Context, address string) (*tls.Conn, bool, error) {
+	select {
+	case conn := <-t.idle:
+		return conn, true, nil
+	default:
+	}
+
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Deadline: attemptDeadline(ctx)}, Config: t.config}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, false, err
+	}
+	return conn.(*tls.Conn), false, nil
+}
+
+// release keeps conn for the next query, or closes it when enough are kept already
+func (t *dotTransport) release(conn *tls.Conn) {
+	conn.SetDeadline(time.Time{})
+	select {
+	case t.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCertificate makes a self-signed certificate for 127.0.0.1 and a pool
+// holding it, for servers the transports have to trust through -tls-ca
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// echoAnswer turns a packed query into a response by setting the QR bit,
+// which is all the transports need to see
+func echoAnswer(query []byte) []byte {
+	answer := append([]byte{}, query...)
+	answer[2] |= 0x80
+	return answer
+}
+
+// dotServer is a stand-in DNS over TLS server on 127.0.0.1. It counts the
+// connections it accepts, and with closeIdle hangs up after every answer
+// like a server whose idle timeout ran out.
+type dotServer struct {
+	listener  net.Listener
+	accepted  int32
+	closeIdle bool
+}
+
+func startDoTServer(t *testing.T, certificate tls.Certificate, closeIdle bool) *dotServer {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dotServer{listener: listener, closeIdle: closeIdle}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&server.accepted, 1)
+			go server.handle(conn)
+		}
+	}()
+	return server
+}
+
+func (s *dotServer) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		if err := writeTCPMessage(conn, echoAnswer(query)); err != nil || s.closeIdle {
+			return
+		}
+	}
+}
+
+// exchangeTwice sends two queries over transport and checks both answers
+func exchangeTwice(t *testing.T, transport Transport, address string) {
+	t.Helper()
+	for i := 0; i < 2; i++ {
+		query := testMessage(t, uint16(100+i), false, testQuestion(t, "www.example.org."), [4]byte{})
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		answer, err := transport.Exchange(ctx, address, query, 512)
+		cancel()
+		if err != nil {
+			t.Fatalf("query %d: %v", i+1, err)
+		}
+		if _, _, err := parseResponse(answer, uint16(100+i), testQuestion(t, "www.example.org.")); err != nil {
+			t.Fatalf("query %d: %v", i+1, err)
+		}
+	}
+}
+
+// useRootCAs sets tlsRootCAs, like -tls-ca, for the rest of the test
+func useRootCAs(t *testing.T, pool *x509.CertPool) {
+	old := tlsRootCAs
+	t.Cleanup(func() { tlsRootCAs = old })
+	tlsRootCAs = pool
+}
+
+func TestDoTRejectsUntrustedCertificate(t *testing.T) {
+	certificate, _ := testCertificate(t)
+	server := startDoTServer(t, certificate, false)
+	useRootCAs(t, nil)
+
+	query := testMessage(t, 1, false, testQuestion(t, "www.example.org."), [4]byte{})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := newDoTTransport("127.0.0.1").Exchange(ctx, server.listener.Addr().String(), query, 512); err == nil {
+		t.Fatal("a self-signed certificate was accepted without -tls-ca")
+	}
+}
+
+func TestDoTReusesIdleConnection(t *testing.T) {
+	certificate, pool := testCertificate(t)
+	server := startDoTServer(t, certificate, false)
+	useRootCAs(t, pool)
+
+	exchangeTwice(t, newDoTTransport("127.0.0.1"), server.listener.Addr().String())
+	if accepted := atomic.LoadInt32(&server.accepted); accepted != 1 {
+		t.Errorf("two queries took %d connections, want 1", accepted)
+	}
+}
+
+func TestDoTRetriesClosedIdleConnection(t *testing.T) {
+	certificate, pool := testCertificate(t)
+	server := startDoTServer(t, certificate, true)
+	useRootCAs(t, pool)
+
+	/* the second query finds its idle connection closed by the server and has to dial again */
+	exchangeTwice(t, newDoTTransport("127.0.0.1"), server.listener.Addr().String())
+	if accepted := atomic.LoadInt32(&server.accepted); accepted != 2 {
+		t.Errorf("two queries took %d connections, want 2", accepted)
+	}
+}
+
+func TestDoTWrongServerName(t *testing.T) {
+	certificate, pool := testCertificate(t)
+	server := startDoTServer(t, certificate, false)
+	useRootCAs(t, pool)
+
+	query := testMessage(t, 1, false, testQuestion(t, "www.example.org."), [4]byte{})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := newDoTTransport("dns.example.net").Exchange(ctx, server.listener.Addr().String(), query, 512); err == nil {
+		t.Fatal("a certificate for 127.0.0.1 was accepted for dns.example.net")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// forwarder is one upstream resolver of -forward
+type forwarder struct {
+	address   string    // host:port, or the URL for DNS over HTTPS
+	transport Transport // nil for plain DNS, which goes through upstreamTransport
+}
+
+// forwarders are the upstream resolvers of -forward. When there are any,
+// every question is sent to them with RD set instead of walking the tree
+// from the root.
+var forwarders []forwarder
+
+// tlsRootCAs are the certificate authorities DNS over TLS and HTTPS servers
+// are verified against, the system's own unless -tls-ca is given
+var tlsRootCAs *x509.CertPool
+
+// preferredForwarder is the index of the forwarder that answered last. Every
+// lookup starts there, so a dead forwarder costs one timeout instead of one
+// per lookup.
+var preferredForwarder int32
+
+// parseForwarders splits the -forward list. Every entry is one of
+//
+//	10.0.0.2 or 10.0.0.2:53              plain DNS
+//	tls://1.1.1.1 or tls://1.1.1.1:853   DNS over TLS, the certificate must be valid for the IP
+//	tls://1.1.1.1#cloudflare-dns.com     DNS over TLS, the certificate must be valid for the name
+//	https://dns.example/dns-query        DNS over HTTPS
+func parseForwarders(list string) ([]forwarder, error) {
+	parsed := []forwarder{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(entry, "https://"):
+			if _, err := url.Parse(entry); err != nil {
+				return nil, fmt.Errorf("forwarder %s: %w", entry, err)
+			}
+			parsed = append(parsed, forwarder{address: entry, transport: newDoHTransport()})
+
+		case strings.HasPrefix(entry, "tls://"):
+			u, err := url.Parse(entry)
+			if err != nil {
+				return nil, fmt.Errorf("forwarder %s: %w", entry, err)
+			}
+			address := withDefaultPort(u.Host, "853")
+			serverName := u.Fragment
+			if serverName == "" {
+				serverName = u.Hostname()
+			}
+			parsed = append(parsed, forwarder{address: address, transport: newDoTTransport(serverName)})
+
+		default:
+			address := withDefaultPort(entry, "53")
+			host, _, _ := net.SplitHostPort(address)
+			if net.ParseIP(host) == nil {
+				return nil, fmt.Errorf("forwarder %s is not an IP address", entry)
+			}
+			parsed = append(parsed, forwarder{address: address})
+		}
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("no forwarders in %q", list)
+	}
+	return parsed, nil
+}
+
+// withDefaultPort adds port to an address that doesn't have one
+func withDefaultPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	return address
+}
+
+// loadRootCAs reads the PEM certificates of -tls-ca
+func loadRootCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// forwardQuery answers question from the cache, or else from the first
+// forwarder that gives a usable answer. A forwarder that doesn't answer, fails
+// (SERVFAIL), refuses or doesn't offer recursion is skipped for the next one.
+// Each forwarder is asked over its own transport.
+func forwardQuery(ctx context.Context, question dnsmessage.Question) (*Response, error) {
+	if response, ok := cachedResponse(ctx, 0, question); ok {
+		return response, nil
+	}
+
+	start := int(atomic.LoadInt32(&preferredForwarder))
+	var lastErr error
+	for i := range forwarders {
+		index := (start + i) % len(forwarders)
+		address, transport := forwarders[index].address, forwarders[index].transport
+		if transport == nil {
+			transport = upstreamTransport
+		}
+
+		sent := time.Now()
+		p, header, _, err := askServers(ctx, transport, []string{address}, question, true)
+		rtt := time.Since(sent)
+		if err != nil {
+			tracef(ctx, 0, ";; no answer from forwarder %s: %v", address, err)
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if header.RCode == dnsmessage.RCodeServerFailure || header.RCode == dnsmessage.RCodeRefused || !header.RecursionAvailable {
+			tracef(ctx, 0, ";; forwarder %s answered %s, recursion available: %v", address, rcodeName(header.RCode), header.RecursionAvailable)
+			lastErr = fmt.Errorf("%s answered %s", address, rcodeName(header.RCode))
+			continue
+		}
+
+		answers, err := p.AllAnswers()
+		if err != nil {
+			lastErr = fmt.Errorf("parsing the answers from %s: %w", address, err)
+			continue
+		}
+		authorities, err := p.AllAuthorities()
+		if err != nil {
+			lastErr = fmt.Errorf("parsing the authorities from %s: %w", address, err)
+			continue
+		}
+		traceResponse(ctx, 0, question, "", address, header, answers, authorities, nil, rtt)
+		atomic.StoreInt32(&preferredForwarder, int32(index))
+
+		/* the answers go in the same cache the recursive walk uses. Only the CNAME chain from the
+		   question's name is kept, unrelated records a forwarder adds aren't trusted */
+		answers = answerChain(question, answers)
+		resolverCache.Add(answers, rankAnswer)
+		if header.RCode == dnsmessage.RCodeNameError || (header.RCode == dnsmessage.RCodeSuccess && len(answers) == 0) {
+			resolverCache.AddNegative(question, header.RCode, authorities)
+			negative := negativeMessage(header.RCode, authorities)
+			negative.Server = address
+			return negative, nil
+		}
+		proof := denialProof(authorities)
+		if len(proof) > 0 {
+			resolverCache.AddProof(answers, proof)
+		}
+		return &Response{Message: dnsmessage.Message{
+			Header:      dnsmessage.Header{Response: true, RCode: header.RCode},
+			Answers:     answers,
+			Authorities: proof,
+		}, Server: address}, nil
+	}
+
+	return nil, fmt.Errorf("none of the %d forwarders answered: %w", len(forwarders), lastErr)
+}
+
+// answerChain keeps the records of answers that answer question: the CNAME
+// chain from the question's name, the records of the question's type where it
+// ends, and the RRSIG records over them
+func answerChain(question dnsmessage.Question, answers []dnsmessage.Resource) []dnsmessage.Resource {
+	kept := []dnsmessage.Resource{}
+	sets := map[cacheKey]bool{}
+	keep := func(records []dnsmessage.Resource) {
+		kept = append(kept, records...)
+		for _, record := range records {
+			sets[newCacheKey(record.Header.Name.String(), record.Header.Type, record.Header.Class)] = true
+		}
+	}
+
+	/* an ANY answer is every record of the name itself */
+	if question.Type == dnsmessage.TypeALL {
+		for _, answer := range answers {
+			if answer.Header.Type != typeRRSIG && strings.EqualFold(answer.Header.Name.String(), question.Name.String()) {
+				keep([]dnsmessage.Resource{answer})
+			}
+		}
+	}
+
+	name := question.Name
+	for i := 0; i <= maxCNAMEChain && question.Type != dnsmessage.TypeALL; i++ {
+		if records := answersFor(answers, name, question.Type); len(records) > 0 {
+			keep(records)
+			break
+		}
+		cnames := answersFor(answers, name, dnsmessage.TypeCNAME)
+		if question.Type == dnsmessage.TypeCNAME || len(cnames) == 0 {
+			break
+		}
+		keep(cnames[:1])
+		name, _ = recordTarget(cnames[0].Body)
+	}
+
+	for _, answer := range answers {
+		if answer.Header.Type == typeRRSIG && sets[newCacheKey(answer.Header.Name.String(), coveredType(answer), answer.Header.Class)] {
+			kept = append(kept, answer)
+		}
+	}
+	return kept
+}
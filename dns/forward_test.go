@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// useForwarders sends every query to addresses with -forward, through transport
+func useForwarders(t *testing.T, transport Transport, addresses ...string) {
+	useUpstream(t, transport)
+	for _, address := range addresses {
+		forwarders = append(forwarders, forwarder{address: address})
+	}
+}
+
+func TestForwardCachesOnlyTheChain(t *testing.T) {
+	useForwarders(t, fakeServer(func(address string, question dnsmessage.Question, reply *dnsmessage.Message) {
+		reply.Header.RecursionAvailable = true
+		reply.Answers = []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("www.site.test.")},
+			},
+			fakeA("www.site.test.", 192, 0, 2, 10),
+			fakeRRSIG("www.site.test.", dnsmessage.TypeA),
+			// records nobody asked for, a forwarder can't be trusted with them
+			fakeA("bank.test.", 6, 6, 6, 6),
+			fakeRRSIG("bank.test.", dnsmessage.TypeA),
+			fakeA("mail.site.test.", 6, 6, 6, 6),
+		}
+	}), "10.0.0.1:53")
+
+	response := lookupA(t, "alias.site.test.")
+	want := "alias.site.test. CNAME www.site.test.; www.site.test. A 192.0.2.10; www.site.test. RRSIG "
+	if got := strings.Join(answerStrings(response.Answers), "; "); got != want {
+		t.Errorf("answers = %q, want %q", got, want)
+	}
+
+	if got := cachedAddress(t, resolverCache, "www.site.test."); got != "www.site.test. A 192.0.2.10" {
+		t.Errorf("www.site.test. is cached as %s", got)
+	}
+	if len(resolverCache.Signatures("www.site.test.", dnsmessage.TypeA, dnsmessage.ClassINET)) != 1 {
+		t.Errorf("the signature over www.site.test. A wasn't cached")
+	}
+	for _, name := range []string{"bank.test.", "mail.site.test."} {
+		if records, ok := resolverCache.Get(name, dnsmessage.TypeA, dnsmessage.ClassINET); ok {
+			t.Errorf("%s A was cached off the chain: %v", name, answerStrings(records))
+		}
+	}
+	if signatures := resolverCache.Signatures("bank.test.", dnsmessage.TypeA, dnsmessage.ClassINET); len(signatures) != 0 {
+		t.Errorf("the signature over bank.test. A was cached")
+	}
+}
+
+func TestForwardFailover(t *testing.T) {
+	var mu sync.Mutex
+	asked := map[string]int{}
+	answer := fakeServer(func(address string, question dnsmessage.Question, reply *dnsmessage.Message) {
+		reply.Header.RecursionAvailable = true
+		if address == "10.0.0.1:53" {
+			reply.Header.RCode = dnsmessage.RCodeServerFailure
+			return
+		}
+		reply.Answers = []dnsmessage.Resource{fakeA(question.Name.String(), 192, 0, 2, 10)}
+	})
+	useForwarders(t, TransportFunc(func(ctx context.Context, address string, query []byte, bufferSize int) ([]byte, error) {
+		mu.Lock()
+		asked[address]++
+		mu.Unlock()
+		if address == "10.0.0.2:53" {
+			return nil, fmt.Errorf("i/o timeout")
+		}
+		return answer.Exchange(ctx, address, query, bufferSize)
+	}), "10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53")
+
+	/* the first forwarder fails and the second doesn't answer, so the third one answers */
+	response := lookupA(t, "www.site.test.")
+	if response.Server != "10.0.0.3:53" {
+		t.Fatalf("answered by %q, want 10.0.0.3:53", response.Server)
+	}
+	if preferredForwarder != 2 {
+		t.Errorf("preferred forwarder is %d, want 2, the one that answered", preferredForwarder)
+	}
+
+	/* the next lookup goes straight to the forwarder that worked */
+	mu.Lock()
+	failed, silent := asked["10.0.0.1:53"], asked["10.0.0.2:53"]
+	mu.Unlock()
+	if failed == 0 || silent == 0 {
+		t.Fatalf("the failing forwarders were asked %d and %d times, want both tried first", failed, silent)
+	}
+	response = lookupA(t, "mail.site.test.")
+	if response.Server != "10.0.0.3:53" {
+		t.Errorf("second lookup answered by %q, want 10.0.0.3:53", response.Server)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if asked["10.0.0.1:53"] != failed || asked["10.0.0.2:53"] != silent {
+		t.Errorf("the failing forwarders were asked again after 10.0.0.3:53 answered")
+	}
+	if preferredForwarder != 2 {
+		t.Errorf("preferred forwarder moved to %d", preferredForwarder)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// loadRootHints reads the root servers from a file in the format of IANA's
+// named.root (https://www.internic.net/domain/named.root): zone file lines
+// with the NS records of the root zone and the A and AAAA records of those
+// nameservers. The addresses come back IPv4 first, and IPv6 only with -6.
+func loadRootHints(path string) ([]net.IP, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	nameservers := map[string]bool{}
+	addresses := map[string][]net.IP{}
+	order := []string{}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		/* everything after a ; is a comment */
+		text, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// name [ttl] [class] type data, the TTL and class can be left out
+		name := strings.ToLower(fields[0])
+		rest := fields[1:]
+		for len(rest) > 2 && (isNumber(rest[0]) || strings.EqualFold(rest[0], "IN")) {
+			rest = rest[1:]
+		}
+		if len(rest) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected a name, type and data: %q", path, line, scanner.Text())
+		}
+
+		switch strings.ToUpper(rest[0]) {
+		case "NS":
+			if name != "." {
+				return nil, fmt.Errorf("%s line %d: NS record for %s, only the root zone belongs in root hints", path, line, name)
+			}
+			nameserver := strings.ToLower(rest[1])
+			if !nameservers[nameserver] {
+				nameservers[nameserver] = true
+				order = append(order, nameserver)
+			}
+		case "A", "AAAA":
+			ip := net.ParseIP(rest[1])
+			if ip == nil {
+				return nil, fmt.Errorf("%s line %d: bad address %q", path, line, rest[1])
+			}
+			addresses[name] = append(addresses[name], ip)
+		default:
+			return nil, fmt.Errorf("%s line %d: unexpected record type %s", path, line, rest[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	/* only the addresses of the nameservers of the root count, IPv6 after all of IPv4 */
+	servers, ipv6Servers := []net.IP{}, []net.IP{}
+	for _, nameserver := range order {
+		for _, ip := range addresses[nameserver] {
+			if ip.To4() != nil {
+				servers = append(servers, ip)
+			} else if useIPv6 {
+				ipv6Servers = append(ipv6Servers, ip)
+			}
+		}
+	}
+	servers = append(servers, ipv6Servers...)
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%s holds no addresses for the root nameservers", path)
+	}
+	return servers, nil
+}
+
+// isNumber reports whether s is made of digits only, like a TTL
+func isNumber(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// namedRoot is the start of IANA's named.root, comments included
+const namedRoot = `;       This file holds the information on root name servers needed to
+;       initialize cache of Internet domain name servers
+;       (e.g. reference this file in the "cache  .  <file>"
+;       configuration file of BIND domain name servers).
+;
+;       This file is made available by InterNIC
+;       under anonymous FTP as
+;           file                /domain/named.cache
+;           on server           FTP.INTERNIC.NET
+;       -OR-                    RS.INTERNIC.NET
+;
+;       last update:     January 24, 2024
+;       related version of root zone:     2024012401
+;
+; FORMERLY NS.INTERNIC.NET
+;
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+;
+; FORMERLY NS1.ISI.EDU
+;
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+B.ROOT-SERVERS.NET.      3600000      AAAA  2801:1b8:10::b
+;
+; FORMERLY C.PSI.NET
+;
+.                        3600000      NS    C.ROOT-SERVERS.NET.
+C.ROOT-SERVERS.NET.      3600000      A     192.33.4.12
+C.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2::c
+; End of file
+`
+
+func writeHints(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "named.root")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRootHints(t *testing.T) {
+	defer func(old bool) { useIPv6 = old }(useIPv6)
+	path := writeHints(t, namedRoot)
+
+	tests := []struct {
+		ipv6 bool
+		want []string
+	}{
+		{false, []string{"198.41.0.4", "170.247.170.2", "192.33.4.12"}},
+		{true, []string{"198.41.0.4", "170.247.170.2", "192.33.4.12", "2001:503:ba3e::2:30", "2801:1b8:10::b", "2001:500:2::c"}},
+	}
+	for _, test := range tests {
+		useIPv6 = test.ipv6
+		servers, err := loadRootHints(path)
+		if err != nil {
+			t.Fatalf("-6 %v: %v", test.ipv6, err)
+		}
+		if len(servers) != len(test.want) {
+			t.Fatalf("-6 %v: got %v, want %v", test.ipv6, servers, test.want)
+		}
+		for i, want := range test.want {
+			if !servers[i].Equal(net.ParseIP(want)) {
+				t.Errorf("-6 %v: server %d is %s, want %s", test.ipv6, i, servers[i], want)
+			}
+		}
+	}
+}
+
+func TestLoadRootHintsErrors(t *testing.T) {
+	tests := map[string]string{
+		"no addresses":    ".  3600000  NS  A.ROOT-SERVERS.NET.\n",
+		"bad address":     ".  3600000  NS  A.ROOT-SERVERS.NET.\nA.ROOT-SERVERS.NET.  3600000  A  198.41.0\n",
+		"NS outside root": "net.  3600000  NS  A.ROOT-SERVERS.NET.\n",
+		"unknown type":    "A.ROOT-SERVERS.NET.  3600000  MX  10 mail.\n",
+		"unrelated glue":  "A.ROOT-SERVERS.NET.  3600000  A  198.41.0.4\n",
+	}
+	for name, content := range tests {
+		if servers, err := loadRootHints(writeHints(t, content)); err == nil {
+			t.Errorf("%s: accepted, got %v", name, servers)
+		}
+	}
+
+	if _, err := loadRootHints(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("a missing file was accepted")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// localZone is a zone loaded from a zone file that the resolver answers
+// itself, authoritatively and before any recursion. Records are grouped by
+// their lower case owner name. names holds every name that exists in the zone,
+// including the empty non-terminals between the records and the apex.
+type localZone struct {
+	origin  string
+	file    string
+	soa     dnsmessage.Resource
+	records map[string][]dnsmessage.Resource
+	names   map[string]bool
+}
+
+// localZones are the zones given with -zone
+var localZones []*localZone
+
+// loadLocalZone reads a zone file. The zone's apex is the owner of its SOA
+// record, which the file must have exactly one of, and every other record has
+// to lie inside the zone.
+func loadLocalZone(path string) (*localZone, error) {
+	resources, err := parseZoneFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	zone := &localZone{file: path, records: map[string][]dnsmessage.Resource{}, names: map[string]bool{}}
+	for _, resource := range resources {
+		if resource.Header.Type != dnsmessage.TypeSOA {
+			continue
+		}
+		if zone.origin != "" {
+			return nil, fmt.Errorf("%s: more than one SOA record", path)
+		}
+		zone.origin, zone.soa = strings.ToLower(resource.Header.Name.String()), resource
+	}
+	if zone.origin == "" {
+		return nil, fmt.Errorf("%s: no SOA record", path)
+	}
+
+	for _, resource := range resources {
+		owner := strings.ToLower(resource.Header.Name.String())
+		if !isSubdomain(owner, zone.origin) {
+			return nil, fmt.Errorf("%s: %s is outside the zone %s", path, owner, zone.origin)
+		}
+		zone.records[owner] = append(zone.records[owner], resource)
+		for name := owner; name != zone.origin; name = parentZone(name) {
+			zone.names[name] = true
+		}
+		zone.names[zone.origin] = true
+	}
+	return zone, nil
+}
+
+// localAnswer answers question from the closest local zone that contains its
+// name. It reports false when no local zone does, and the question has to be
+// resolved the normal way. The DS records of a zone's apex live in the
+// parent zone, so those questions aren't answered locally either.
+func localAnswer(ctx context.Context, question dnsmessage.Question) (*Response, bool) {
+	name := strings.ToLower(question.Name.String())
+
+	zone := localZoneOf(name)
+	if zone == nil || (question.Type == typeDS && name == zone.origin) {
+		return nil, false
+	}
+
+	response := zone.answer(question)
+	tracef(ctx, 0, ";; %s %s answered %s from the local zone %s in %s", question.Name, typeName(question.Type),
+		rcodeName(response.Header.RCode), zone.origin, zone.file)
+	return response, true
+}
+
+// localZoneOf returns the closest local zone name lies in, or nil when there is none
+func localZoneOf(name string) *localZone {
+	var zone *localZone
+	for _, candidate := range localZones {
+		if isSubdomain(name, candidate.origin) && (zone == nil || len(candidate.origin) > len(zone.origin)) {
+			zone = candidate
+		}
+	}
+	return zone
+}
+
+// answer looks question up in the zone. A name without records of the
+// question's type answers with its CNAME if it has one, so lookup can follow
+// the alias, and otherwise with NODATA. Names that don't exist get NXDOMAIN,
+// unless a wildcard covers them. Both negative answers carry the SOA record.
+// NS records below the apex are served as plain data, delegations aren't followed.
+func (z *localZone) answer(question dnsmessage.Question) *Response {
+	response := &Response{
+		Message: dnsmessage.Message{Header: dnsmessage.Header{Response: true}},
+		Server:  z.file,
+		Local:   true,
+	}
+
+	records := z.records[strings.ToLower(question.Name.String())]
+	if !z.names[strings.ToLower(question.Name.String())] {
+		if records = z.wildcard(question.Name); records == nil {
+			response.Header.RCode = dnsmessage.RCodeNameError
+			response.Authorities = []dnsmessage.Resource{z.negativeSOA()}
+			return response
+		}
+	}
+
+	for _, typ := range []dnsmessage.Type{question.Type, dnsmessage.TypeCNAME} {
+		for _, record := range records {
+			if record.Header.Type == typ || question.Type == dnsmessage.TypeALL {
+				response.Answers = append(response.Answers, record)
+			}
+		}
+		if len(response.Answers) > 0 {
+			return response
+		}
+	}
+
+	response.Authorities = []dnsmessage.Resource{z.negativeSOA()}
+	return response
+}
+
+// wildcard returns the records a wildcard synthesizes for a name that doesn't
+// exist in the zone (RFC 4592). Only the wildcard right below the closest
+// existing ancestor of the name applies. The records are renamed to name.
+func (z *localZone) wildcard(name dnsmessage.Name) []dnsmessage.Resource {
+	encloser := strings.ToLower(name.String())
+	for !z.names[encloser] {
+		encloser = parentZone(encloser)
+	}
+
+	records := []dnsmessage.Resource{}
+	for _, record := range z.records["*."+encloser] {
+		record.Header.Name = name
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return records
+}
+
+// negativeSOA returns the SOA record for the authority section of a negative
+// answer. Its TTL is the smaller of its own and the MINIMUM field (RFC 2308 section 3).
+func (z *localZone) negativeSOA() dnsmessage.Resource {
+	soa := z.soa
+	if minimum := soa.Body.(*dnsmessage.SOAResource).MinTTL; minimum < soa.Header.TTL {
+		soa.Header.TTL = minimum
+	}
+	return soa
+}
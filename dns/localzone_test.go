@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testLocalZone has a wildcard below wild, and deep and b.deep are empty
+// non-terminals above a.b.deep
+const testLocalZone = `$ORIGIN example.test.
+$TTL 300
+@        SOA   ns hostmaster 1 3600 600 86400 60
+@        NS    ns
+ns       A     192.0.2.53
+www      A     192.0.2.1
+alias    CNAME www
+*.wild   A     192.0.2.2
+a.b.deep A     192.0.2.3
+`
+
+func TestLocalZoneAnswer(t *testing.T) {
+	zone, err := loadLocalZone(writeZone(t, testLocalZone))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		typ     dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers string // empty for a negative answer, which must carry the SOA
+	}{
+		{"www.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "www.example.test. A 192.0.2.1"},
+		{"WWW.Example.Test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "www.example.test. A 192.0.2.1"},
+		{"www.example.test.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, ""},
+		{"missing.example.test.", dnsmessage.TypeA, dnsmessage.RCodeNameError, ""},
+		{"alias.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "alias.example.test. CNAME www.example.test."},
+		{"alias.example.test.", dnsmessage.TypeCNAME, dnsmessage.RCodeSuccess, "alias.example.test. CNAME www.example.test."},
+		{"host.wild.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "host.wild.example.test. A 192.0.2.2"},
+		{"a.b.wild.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "a.b.wild.example.test. A 192.0.2.2"},
+		{"host.wild.example.test.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, ""},
+		// the wildcard only stands in for names that don't exist, wild itself does
+		{"wild.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, ""},
+		{"deep.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, ""},
+		{"b.deep.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, ""},
+		{"a.b.deep.example.test.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "a.b.deep.example.test. A 192.0.2.3"},
+		{"c.deep.example.test.", dnsmessage.TypeA, dnsmessage.RCodeNameError, ""},
+	}
+	for _, test := range tests {
+		question := dnsmessage.Question{Name: dnsmessage.MustNewName(test.name), Type: test.typ, Class: dnsmessage.ClassINET}
+		response := zone.answer(question)
+		if response.Header.RCode != test.rcode {
+			t.Errorf("%s %s: rcode %s, want %s", test.name, typeName(test.typ), rcodeName(response.Header.RCode), rcodeName(test.rcode))
+		}
+		if got := strings.Join(answerStrings(response.Answers), "; "); got != test.answers {
+			t.Errorf("%s %s: answers %q, want %q", test.name, typeName(test.typ), got, test.answers)
+		}
+		if !response.Local {
+			t.Errorf("%s %s: answer isn't marked local", test.name, typeName(test.typ))
+		}
+
+		if test.answers != "" {
+			continue
+		}
+		/* a negative answer carries the SOA with the TTL limited to its MINIMUM field */
+		if len(response.Authorities) != 1 || response.Authorities[0].Header.Type != dnsmessage.TypeSOA {
+			t.Errorf("%s %s: authorities %v, want the SOA", test.name, typeName(test.typ), response.Authorities)
+		} else if ttl := response.Authorities[0].Header.TTL; ttl != 60 {
+			t.Errorf("%s %s: SOA TTL %d, want 60", test.name, typeName(test.typ), ttl)
+		}
+	}
+}
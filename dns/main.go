@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"crypto/rand"
 	"flag"
 	"fmt"
@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
@@ -19,8 +20,13 @@ const (
 	TYPE_A     RecordType = 1
 	TYPE_NS    RecordType = 2
 	TYPE_CNAME RecordType = 5
+	TYPE_SOA   RecordType = 6
+	TYPE_PTR   RecordType = 12
+	TYPE_MX    RecordType = 15
 	TYPE_TXT   RecordType = 16
 	TYPE_AAAA  RecordType = 28
+	TYPE_SRV   RecordType = 33
+	TYPE_CAA   RecordType = 257
 )
 
 var RecordTypes map[string]RecordType = map[string]RecordType{
@@ -29,20 +35,172 @@ var RecordTypes map[string]RecordType = map[string]RecordType{
 	"CNAME": TYPE_CNAME,
 	"TXT":   TYPE_TXT,
 	"AAAA":  TYPE_AAAA,
+	"MX":    TYPE_MX,
+	"SOA":   TYPE_SOA,
+	"PTR":   TYPE_PTR,
+	"SRV":   TYPE_SRV,
+	"CAA":   TYPE_CAA,
 }
 
 func main() {
-	// get all command line arguments
-	names := os.Args[1:]
 	t := flag.String("t", "A", "the record type to query for each name")
+	serveAddress := flag.String("serve", "", "run as a DNS server listening on this address (UDP and TCP) instead of resolving names")
+	dohAddress := flag.String("serve-doh", "", "serve DNS over HTTPS on "+dohPath+" at this address, can be combined with -serve")
+	dohCert := flag.String("doh-cert", "", "PEM certificate for -serve-doh, without it plain HTTP is served for use behind a TLS proxy")
+	dohKey := flag.String("doh-key", "", "PEM private key of -doh-cert")
+	flag.StringVar(&rootServers, "roots", ROOT_SERVERS, "comma separated addresses of the root servers every lookup starts at")
+	forward := flag.String("forward", "", "comma separated upstream resolvers to forward every query to instead of recursing: ip[:port], tls://ip[:port][#name] or https://url")
+	tlsCA := flag.String("tls-ca", "", "PEM file with the certificate authorities to verify DNS over TLS and HTTPS forwarders with, instead of the system's")
+	dohMethod := flag.String("doh-method", "POST", "the HTTP method for DNS over HTTPS forwarders, GET or POST")
+	rootHints := flag.String("root-hints", "", "read the root servers from a file in named.root format instead of using -roots")
+	flag.StringVar(&upstreamPort, "upstream-port", "53", "the port nameservers are queried on")
+	reverse := flag.Bool("x", false, "reverse lookup: the names are IPv4 or IPv6 addresses and their PTR records are resolved")
+	flag.IntVar(&maxReferrals, "max-referrals", maxReferrals, "how many referrals to follow for one name before giving up")
+	flag.DurationVar(&queryTimeout, "timeout", queryTimeout, "how long to wait for a single nameserver to answer")
+	flag.IntVar(&queryRetries, "retries", queryRetries, "how many more times to go through the nameservers of a zone when none of them answers")
+	flag.DurationVar(&lookupTimeout, "lookup-timeout", lookupTimeout, "how long the lookup of one name may take in total")
+	flag.BoolVar(&useCaseRandomization, "0x20", false, "randomize the case of outgoing names and reject answers that don't copy it")
+	flag.BoolVar(&useIPv6, "6", false, "also use AAAA glue and query nameservers over IPv6")
+	all := flag.Bool("all", false, "print every record of the answer, one line each, instead of only the first")
+	inputFile := flag.String("f", "", "read the names from this file, - for stdin, one name or \"name,type\" per line")
+	flag.IntVar(&concurrency, "concurrency", concurrency, "how many names to resolve at the same time")
+	flag.BoolVar(&traceEnabled, "trace", false, "print every step of the walk from the root servers down, like dig +trace")
+	flag.StringVar(&outputFormat, "o", outputFormat, "the output format: text, csv or json (one object per line)")
+	bufsize := flag.Uint("bufsize", uint(ednsBufferSize), "the EDNS(0) UDP payload size to advertise, 0 sends plain DNS queries")
+	flag.BoolVar(&dnssecEnabled, "dnssec", false, "request DNSSEC records and validate every answer from the root trust anchor down")
+	customAnchors := false
+	flag.Func("trust-anchor", "a root DS record \"keytag algorithm digesttype digest\" to trust instead of the IANA root keys, can be repeated", func(anchor string) error {
+		if !customAnchors {
+			rootTrustAnchors, customAnchors = nil, true
+		}
+		if _, err := parseTrustAnchors([]string{anchor}); err != nil {
+			return err
+		}
+		rootTrustAnchors = append(rootTrustAnchors, anchor)
+		return nil
+	})
+	flag.Func("zone", "a zone file in RFC 1035 master format to answer authoritatively instead of recursing, can be repeated", func(path string) error {
+		zone, err := loadLocalZone(path)
+		if err != nil {
+			return err
+		}
+		localZones = append(localZones, zone)
+		return nil
+	})
 	flag.Parse()
 
+	if *bufsize > maxTCPResponseSize {
+		fmt.Printf("The EDNS buffer size can't be bigger than %d\n", maxTCPResponseSize)
+		os.Exit(1)
+	}
+	ednsBufferSize = uint16(*bufsize)
+	// root hints replace the built in root servers
+	if *rootHints != "" {
+		servers, err := loadRootHints(*rootHints)
+		if err != nil {
+			fmt.Printf("Error reading the root hints: %v\n", err)
+			os.Exit(1)
+		}
+		addresses := []string{}
+		for _, server := range servers {
+			addresses = append(addresses, server.String())
+		}
+		rootServers = strings.Join(addresses, ",")
+	}
+	if _, err := parseRootServers(rootServers); err != nil {
+		fmt.Printf("Error reading the root servers: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *tlsCA != "" {
+		var err error
+		if tlsRootCAs, err = loadRootCAs(*tlsCA); err != nil {
+			fmt.Printf("Error reading the certificate authorities: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	switch strings.ToUpper(*dohMethod) {
+	case "GET":
+		dohUseGET = true
+	case "POST":
+	default:
+		fmt.Printf("The DNS over HTTPS method must be GET or POST\n")
+		os.Exit(1)
+	}
+
+	if *forward != "" {
+		var err error
+		if forwarders, err = parseForwarders(*forward); err != nil {
+			fmt.Printf("Error reading the forwarders: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// the DO bit travels in the OPT record, and signatures rarely fit in 512 bytes anyway
+	if dnssecEnabled && ednsBufferSize == 0 {
+		fmt.Println("-dnssec needs EDNS, the buffer size can't be 0")
+		os.Exit(1)
+	}
+
+	if (*dohCert == "") != (*dohKey == "") {
+		fmt.Println("-doh-cert and -doh-key must be given together")
+		os.Exit(1)
+	}
+
+	// serve mode answers queries until the process is stopped, or one of the listeners fails
+	if *serveAddress != "" || *dohAddress != "" {
+		errs := make(chan error, 2)
+		if *serveAddress != "" {
+			fmt.Printf("Serving DNS on %s\n", *serveAddress)
+			go func() { errs <- fmt.Errorf("%s: %w", *serveAddress, serve(*serveAddress)) }()
+		}
+		if *dohAddress != "" {
+			scheme := "https"
+			if *dohCert == "" {
+				scheme = "http"
+			}
+			fmt.Printf("Serving DNS over HTTPS on %s://%s%s\n", scheme, *dohAddress, dohPath)
+			go func() { errs <- fmt.Errorf("%s: %w", *dohAddress, serveDoH(*dohAddress, *dohCert, *dohKey)) }()
+		}
+		fmt.Printf("Error serving DNS on %v\n", <-errs)
+		os.Exit(1)
+	}
+
+	// get all the names left after the flags, and the ones from -f after them
+	names := flag.Args()
+	if *inputFile != "" {
+		fileNames, err := readNames(*inputFile)
+		if err != nil {
+			fmt.Printf("Error reading the names: %v\n", err)
+			os.Exit(1)
+		}
+		names = append(names, fileNames...)
+	}
+
 	// input validation
 	if len(names) == 0 {
 		fmt.Println("Not enough arguments, must pass in at least one name")
 		os.Exit(1)
 	}
 
+	switch outputFormat {
+	case "text", "csv", "json":
+	default:
+		fmt.Printf("Output format %s doesn't exist. Must be text, csv or json\n", outputFormat)
+		os.Exit(1)
+	}
+
+	// a trace is lines of text, it has no place in CSV rows
+	if traceEnabled && outputFormat == "csv" {
+		fmt.Println("-trace can't be combined with -o csv")
+		os.Exit(1)
+	}
+
+	if concurrency < 1 {
+		fmt.Println("The concurrency must be at least 1")
+		os.Exit(1)
+	}
+
 	if _, exists := RecordTypes[*t]; !exists {
 		keys := make([]string, 0, len(RecordTypes))
 		for k := range RecordTypes {
@@ -52,19 +210,57 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Invoke the resolve function for each of the given names
-	for _, name := range names {
-		fmt.Printf("%s,%s\n", name, strings.Join(resolve(name, RecordTypes[*t]), ""))
+	// Invoke the resolve function for each of the given names, several at a time
+	resolveName := func(entry string) []string {
+		// a name can carry its own record type as "name,type"
+		name, recordType, err := parseEntry(entry, RecordTypes[*t])
+		if err != nil {
+			return formatResult(name, lookupResult{typ: dnsmessage.Type(recordType), err: fmt.Errorf("reading %s: %w", entry, err)}, *all)
+		}
+		lookupName := name
+
+		// with -x the name is an address, and its hostname is a PTR record under in-addr.arpa or ip6.arpa
+		if *reverse {
+			arpaName, err := reverseName(name)
+			if err != nil {
+				return formatResult(name, lookupResult{typ: dnsmessage.TypePTR, err: fmt.Errorf("building the reverse name: %w", err)}, *all)
+			}
+			lookupName, recordType = arpaName, TYPE_PTR
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		var steps *trace
+		if traceEnabled {
+			ctx, steps = withTrace(ctx)
+		}
+		result := resolve(ctx, lookupName, recordType, *all)
+		cancel()
+		if steps != nil {
+			result.trace = steps.Lines()
+		}
+		return formatResult(name, result, *all)
 	}
+	if outputFormat == "csv" {
+		fmt.Println(strings.Join(csvHeader, ","))
+	}
+	resolveInOrder(names, resolveName, func(lines []string) {
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+	})
 
-	fmt.Printf("\n")
+	if outputFormat == "text" {
+		fmt.Printf("\n")
+	}
 }
 
-// Resolver
-func resolve(name string, t RecordType) []string {
+// Resolver, with all set every record of the answer is returned instead of only the first.
+// The whole lookup, referrals and nameserver lookups included, has to finish before ctx ends.
+// With -dnssec the answer is validated as well. Errors are returned in the
+// result rather than printed, the output format decides how to show them.
+func resolve(ctx context.Context, name string, t RecordType, all bool) lookupResult {
 	// most of your code should go here. use a switch statement
 	// so each resolution type goes into a different function
-	resolvedValue := make([]string, 0, 100)
 	hostName := name + "."
 
 	//Resolve the name
@@ -89,22 +285,38 @@ func resolve(name string, t RecordType) []string {
 	case TYPE_TXT:
 		typ = 16
 
+	//mail exchangers, zone authority, reverse names, services and allowed certificate authorities
+	case TYPE_MX:
+		typ = dnsmessage.TypeMX
+
+	case TYPE_SOA:
+		typ = dnsmessage.TypeSOA
+
+	case TYPE_PTR:
+		typ = dnsmessage.TypePTR
+
+	case TYPE_SRV:
+		typ = dnsmessage.TypeSRV
+
+	case TYPE_CAA:
+		typ = typeCAA
+
 	default:
 		fmt.Printf("Unsupported record type: %v\n", t)
 	}
 
 	/* Do query */
-	address, err := query(hostName, typ)
+	values, response, err := query(ctx, hostName, typ, all)
 	if err != nil {
-		fmt.Printf("Error resolving A record for %s: %v\n", name, err)
-		return resolvedValue
+		return lookupResult{typ: typ, err: fmt.Errorf("resolving %s record for %s: %w", typeName(typ), name, err)}
 	}
+	result := lookupResult{typ: typ, values: values, response: response}
 
-	resolvedValue = append(resolvedValue, address) // Convert IP to string
-
-	//Result
-	var result []string = make([]string, 1)
-	result[0] = resolvedValue[0]
+	/* with -dnssec the answer, or the proof there is none, is checked against the chain of trust */
+	if dnssecEnabled {
+		question := dnsmessage.Question{Name: dnsmessage.MustNewName(hostName), Type: typ, Class: dnsmessage.ClassINET}
+		result.status, result.statusErr = validateResponse(ctx, question, response)
+	}
 
 	//Return
 	return result
@@ -115,275 +327,675 @@ func resolve(name string, t RecordType) []string {
 // all the address of root servers
 const ROOT_SERVERS = "198.41.0.4,199.9.14.201,192.33.4.12,199.7.91.13,192.203.230.10,192.5.5.241,192.112.36.4,198.97.190.53"
 
-// convert ROOT_SERVERS to an array of root servers
+// rootServers and upstreamPort can be changed with -roots (or -root-hints) and
+// -upstream-port, which lets the resolver walk a local fake hierarchy instead
+// of the real roots. Setting upstreamTransport goes further and keeps the whole
+// walk inside the process.
+var (
+	rootServers  = ROOT_SERVERS
+	upstreamPort = "53"
+)
+
+// queryTimeout bounds a single attempt at one server, queryRetries is how many
+// more rounds through a server list are made when no server answers, and
+// lookupTimeout bounds a whole lookup including every referral
+var (
+	queryTimeout  = 2 * time.Second
+	queryRetries  = 1
+	lookupTimeout = 15 * time.Second
+)
+
+// ednsBufferSize is the UDP payload size advertised in the OPT record of every
+// query (RFC 6891). 1232 bytes avoids IP fragmentation on nearly every path.
+// 0 leaves the OPT record out, which caps answers at 512 bytes.
+var ednsBufferSize uint16 = 1232
+
+// useIPv6 lets the resolver use AAAA glue and query nameservers over IPv6,
+// which needs a host with IPv6 connectivity. It's turned on with -6.
+var useIPv6 = false
+
+// addressTypes are the record types nameserver addresses are taken from
+func addressTypes() []dnsmessage.Type {
+	if useIPv6 {
+		return []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	}
+	return []dnsmessage.Type{dnsmessage.TypeA}
+}
+
+// isAddressType reports whether records of type typ can give a nameserver address
+func isAddressType(typ dnsmessage.Type) bool {
+	for _, addressType := range addressTypes() {
+		if typ == addressType {
+			return true
+		}
+	}
+	return false
+}
+
+// convert rootServers to an array of root servers. The list was checked by
+// parseRootServers right after the flags were parsed.
 func getRootServers() []net.IP {
-	rootServers := []net.IP{}
-	for _, rootServer := range strings.Split(ROOT_SERVERS, ",") {
-		rootServers = append(rootServers, net.ParseIP(rootServer))
+	servers, _ := parseRootServers(rootServers)
+	return servers
+}
+
+// parseRootServers reads a comma separated list of root server addresses
+func parseRootServers(list string) ([]net.IP, error) {
+	servers := []net.IP{}
+	for _, rootServer := range strings.Split(list, ",") {
+		ip := net.ParseIP(strings.TrimSpace(rootServer))
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address", strings.TrimSpace(rootServer))
+		}
+		servers = append(servers, ip)
 	}
-	return rootServers
+	return servers, nil
 }
 
-// Do query of all the root servers
-func query(name string, TYPE dnsmessage.Type) (string, error) {
+// Do query of all the root servers. Only the first record of the requested
+// type is returned unless all is set. The response the values come from is
+// returned with them.
+func query(ctx context.Context, name string, TYPE dnsmessage.Type, all bool) ([]string, *Response, error) {
 
 	//Do dns query
-	/* build a question*/
+	/* build a question, names from the input can be too long or otherwise invalid */
+	questionName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid name %s: %w", name, err)
+	}
 	Question := dnsmessage.Question{
-		Name:  dnsmessage.MustNewName(name),
+		Name:  questionName,
 		Type:  TYPE,
 		Class: dnsmessage.ClassINET,
 	}
 
-	/* call the function dnsQuery to get a response from all name servers including root server*/
-	response, err := dnsQuery(getRootServers(), Question)
+	/* call the function lookup to get a response from all name servers including root server, following CNAMEs */
+	response, err := lookup(ctx, Question)
 	if err != nil {
-		fmt.Println("rand error: %s", err)
+		return nil, nil, err
 	}
 
-	var INFO string
+	/* the aliases that led to the final records are printed in front of every value */
+	chain := ""
 	for _, answer := range response.Answers {
-		if TYPE == 1 {
-			if strings.Contains(answer.Body.GoString(), "{A: [") {
-				originalStr := strings.Split(strings.Split(answer.Body.GoString(), "}")[0], "{")[2]
-				ip := strings.Replace(originalStr, ", ", ".", -1)
-				INFO = ip
-				break
-			}
+		if answer.Header.Type == dnsmessage.TypeCNAME && TYPE != dnsmessage.TypeCNAME {
+			target, _ := recordTarget(answer.Body)
+			chain += displayName(target) + ","
+		}
+	}
 
-		} else if TYPE == 28 {
-			if strings.Contains(answer.Body.GoString(), "{AAAA: [") {
-				originalStr := strings.Split(strings.Split(answer.Body.GoString(), "}")[0], "{")[2]
-				ip := strings.Replace(originalStr, ", ", ".", -1)
-				//fmt.Printf("IP %s\n", ip)
-				INFO = ip
-				break
-			}
+	/* collect the records of the requested type, using the typed record bodies */
+	values := []string{}
+	for _, answer := range response.Answers {
+		if answer.Header.Type != TYPE {
+			continue
+		}
 
-		} else if TYPE == 2 {
-			if strings.Contains(answer.Body.GoString(), "NS: ") {
-				originalStr := strings.Split(strings.Split(strings.Split(answer.Body.GoString(), "}")[0], "(")[1], ")")[0]
-				ip := strings.Replace(originalStr, ", ", ".", -1)
-				INFO = ip
+		switch TYPE {
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+			ip, _ := recordIP(answer.Body)
+			values = append(values, ip.String())
 
-				/* resovle the name sever */
-				/* Do query */
-				INFO = INFO[1:len(INFO)-2] + "."
-				address, err := query(INFO, 1)
+		case dnsmessage.TypeNS, dnsmessage.TypeCNAME:
+			/* print the target together with its first IPv4 address */
+			target, _ := recordTarget(answer.Body)
+			addresses, _, err := query(ctx, target.String(), dnsmessage.TypeA, false)
+			if err != nil || len(addresses) == 0 {
 				if err != nil {
-					fmt.Printf("Error resolving A record for %s: %v\n", name, err)
-					return INFO, nil
+					fmt.Fprintf(os.Stderr, "Error resolving A record for %s: %v\n", target, err)
 				}
+				values = append(values, displayName(target))
+			} else {
+				values = append(values, displayName(target)+","+addresses[0])
+			}
 
-				INFO += ", " + address
-				break
+		case dnsmessage.TypeTXT:
+			text, _ := recordText(answer.Body)
+			values = append(values, text)
+
+		case dnsmessage.TypeMX, dnsmessage.TypeSOA, dnsmessage.TypePTR, dnsmessage.TypeSRV, typeCAA:
+			if value, ok := formatRecord(answer.Body); ok {
+				values = append(values, value)
 			}
+		}
 
-		} else if TYPE == 5 {
-			if strings.Contains(answer.Body.GoString(), "CNAME: ") {
-				originalStr := strings.Split(strings.Split(strings.Split(answer.Body.GoString(), "}")[0], "(")[1], ")")[0]
-				ip := strings.Replace(originalStr, ", ", ".", -1)
-				INFO = ip
+		if !all {
+			break
+		}
+	}
 
-				/* resovle the name sever */
-				/* Do query */
-				INFO = INFO[1:len(INFO)-2] + "."
-				address, err := query(INFO, 1)
-				if err != nil {
-					fmt.Printf("Error resolving A record for %s: %v\n", name, err)
-					return INFO, nil
-				}
+	for i := range values {
+		values[i] = chain + values[i]
+	}
+	/* an alias whose target has no records of the type still shows the chain */
+	if len(values) == 0 && chain != "" {
+		values = append(values, strings.TrimSuffix(chain, ","))
+	}
+
+	//Return
+	return values, response, nil
 
-				INFO += ", " + address
+}
+
+// maxCNAMEChain is the longest chain of aliases lookup follows
+const maxCNAMEChain = 8
+
+// lookup answers question through dnsQuery and follows CNAMEs for every type.
+// When the name is an alias the question is asked again for the target until
+// records of the requested type show up. The answers of the returned message
+// hold the whole chain of CNAMEs followed by the final records, and then the
+// RRSIG records over them when there are any.
+func lookup(ctx context.Context, question dnsmessage.Question) (*Response, error) {
+	chain := []dnsmessage.Resource{}
+	signatures := []dnsmessage.Resource{}
+	proofs := []dnsmessage.Resource{}
+	visited := map[string]bool{strings.ToLower(question.Name.String()): true}
+	local := true
+
+	for {
+		response, err := dnsQuery(ctx, getRootServers(), question)
+		if err != nil {
+			return nil, err
+		}
+		// a chain that leaves the local zones anywhere holds recursive data
+		local = local && response.Local
+
+		for _, answer := range response.Answers {
+			if answer.Header.Type == typeRRSIG {
+				signatures = append(signatures, answer)
+			}
+		}
+
+		/* walk through the part of the chain this response already holds */
+		name := question.Name
+		records := []dnsmessage.Resource{}
+		for {
+			records = answersFor(response.Answers, name, question.Type)
+			if len(records) > 0 || question.Type == dnsmessage.TypeCNAME {
 				break
 			}
-		} else if TYPE == 16 {
-			if strings.Contains(answer.Body.GoString(), "TXT: ") {
-				//fmt.Print("TXT:", answer.Body.GoString())
-				originalStr := strings.Split(strings.Split(strings.Split(answer.Body.GoString(), "}")[0], "{")[2], "\\")[1]
-				ip := strings.Replace(originalStr, ", ", ".", -1)
-				INFO = ip
+			cnames := answersFor(response.Answers, name, dnsmessage.TypeCNAME)
+			if len(cnames) == 0 {
 				break
 			}
-		} //
 
-	} //for
+			chain = append(chain, cnames[0])
+			name, _ = recordTarget(cnames[0].Body)
+			if visited[strings.ToLower(name.String())] {
+				return nil, fmt.Errorf("CNAME loop: %s points back to %s", displayName(cnames[0].Header.Name), displayName(name))
+			}
+			visited[strings.ToLower(name.String())] = true
+			if len(chain) > maxCNAMEChain {
+				return nil, fmt.Errorf("CNAME chain of %s is longer than %d aliases", displayName(chain[0].Header.Name), maxCNAMEChain)
+			}
+		}
 
-	//Return
-	return INFO, nil
+		/* done when we found the records, or the last name isn't an alias either */
+		if len(records) > 0 || name == question.Name {
+			response.Answers = append(append(chain, records...), signatures...)
+			response.Authorities = append(response.Authorities, proofs...)
+			response.Local = local
+			return response, nil
+		}
 
-} //func
+		/* the target of the chain isn't in this response, so ask for it from the start. A
+		   wildcard proof for the aliases followed so far has to come along to the end */
+		proofs = append(proofs, denialProof(response.Authorities)...)
+		question.Name = name
+	}
+}
 
-func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Message, error) {
+// answersFor returns the records in answers owned by name with type typ
+func answersFor(answers []dnsmessage.Resource, name dnsmessage.Name, typ dnsmessage.Type) []dnsmessage.Resource {
+	records := []dnsmessage.Resource{}
+	for _, answer := range answers {
+		if answer.Header.Type == typ && strings.EqualFold(answer.Header.Name.String(), name.String()) {
+			records = append(records, answer)
+		}
+	}
+	return records
+}
+
+// maxReferrals is how many referrals dnsQuery follows for one question before
+// giving up. Every zone cut between the root and the name costs one.
+var maxReferrals = 16
+
+// maxNameserverDepth limits how deeply lookups of glue-less nameservers may
+// nest, so two zones whose nameservers live in each other can't recurse forever
+const maxNameserverDepth = 4
+
+// Response is the answer to a question together with the address of the
+// authoritative server that gave it. Server is empty for answers from the cache
+// and the path of the zone file for answers from a local zone. Local is set
+// when every record of the answer comes from a local zone.
+type Response struct {
+	dnsmessage.Message
+	Server string
+	Local  bool
+}
+
+// dnsQuery answers question, from the cache when possible. servers are the
+// servers to start at when the cache holds no delegation closer to the name.
+// Names in a local zone (-zone) are answered from its zone file before anything else.
+// With -forward the question goes to the upstream resolvers instead.
+func dnsQuery(ctx context.Context, servers []net.IP, question dnsmessage.Question) (*Response, error) {
+	if response, ok := localAnswer(ctx, question); ok {
+		return response, nil
+	}
+	if len(forwarders) > 0 {
+		return forwardQuery(ctx, question)
+	}
+	return iterativeQuery(ctx, servers, question, 0)
+}
+
+// iterativeQuery follows referrals from servers down to the zone that answers
+// question authoritatively. depth counts the nameserver lookups it's nested in.
+// The returned error says at which zone and which step the walk failed.
+func iterativeQuery(ctx context.Context, servers []net.IP, question dnsmessage.Question, depth int) (*Response, error) {
 	//fmt.Printf("Question: %+v\n", question)
-	for i := 0; i < 3; i++ {
+
+	if response, ok := cachedResponse(ctx, depth, question); ok {
+		return response, nil
+	}
+
+	/* Start at the closest zone we know the nameservers of instead of the root. DS records
+	   live in the parent zone, so a DS question must not start at the child's own servers */
+	zone := "."
+	startName := question.Name.String()
+	if question.Type == typeDS {
+		startName = parentZone(startName)
+	}
+	if cachedZone, cachedServers := resolverCache.Nameservers(startName, addressTypes()); cachedServers != nil {
+		zone, servers = cachedZone, cachedServers
+		tracef(ctx, depth, ";; starting at zone %s, its nameservers are cached", zone)
+	}
+
+	/* every referral must lead to a zone closer to the name, visited catches servers sending us in circles */
+	visited := map[string]bool{strings.ToLower(zone): true}
+	for referrals := 0; ; referrals++ {
 		//call outgoingDnsQuery
-		dnsAnswer, header, err := outgoingDnsQuery(servers, question)
+		sent := time.Now()
+		dnsAnswer, header, server, err := outgoingDnsQuery(ctx, servers, question)
+		rtt := time.Since(sent)
 		if err != nil {
-			return nil, err
+			tracef(ctx, depth, ";; no answer from the servers of zone %s %v: %v", zone, servers, err)
+			return nil, fmt.Errorf("asking the servers of zone %s %v: %w", zone, servers, err)
 		}
 
 		/* Get retunr ansers */
 		parsedAnswers, err := dnsAnswer.AllAnswers()
 		if err != nil {
-			return nil, err
-		}
-
-		if header.Authoritative {
-			return &dnsmessage.Message{
-				Header:  dnsmessage.Header{Response: true},
-				Answers: parsedAnswers,
-			}, nil
-
+			return nil, fmt.Errorf("parsing the answers from zone %s: %w", zone, err)
 		}
 
 		/* Get retunr authorities */
 		authorities, err := dnsAnswer.AllAuthorities()
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("parsing the authorities from zone %s: %w", zone, err)
+		}
+
+		/* Get all the additional coresponding to all the authorities */
+		additionals, err := dnsAnswer.AllAdditionals()
+		if err != nil {
+			return nil, fmt.Errorf("parsing the additionals from zone %s: %w", zone, err)
+		}
+
+		/* Only records inside the zone we asked can be trusted. Anything else, like glue for an
+		   unrelated zone, could send later lookups to a server of the attacker's choice */
+		parsedAnswers = inBailiwick(parsedAnswers, zone)
+		authorities = inBailiwick(authorities, zone)
+		additionals = inBailiwick(additionals, zone)
+		traceResponse(ctx, depth, question, zone, server, header, parsedAnswers, authorities, additionals, rtt)
+
+		/* Cache every record of the response, referrals included, for as long as its TTL says.
+		   Each section is ranked on its own so glue never replaces an answer */
+		resolverCache.Add(parsedAnswers, rankAnswer)
+		resolverCache.Add(authorities, rankAuthority)
+		resolverCache.Add(additionals, rankAdditional)
+
+		/* NXDOMAIN and NODATA replies are cached on their own so the next lookup doesn't walk the tree again */
+		if isNegativeResponse(header, parsedAnswers, authorities) {
+			resolverCache.AddNegative(question, header.RCode, authorities)
+			negative := negativeMessage(header.RCode, authorities)
+			negative.Server = server
+			return negative, nil
+		}
+
+		/* an answer expanded from a wildcard carries the proof that the name itself doesn't exist */
+		if header.Authoritative {
+			proof := denialProof(authorities)
+			if len(proof) > 0 {
+				resolverCache.AddProof(parsedAnswers, proof)
+			}
+			return &Response{Message: dnsmessage.Message{
+				Header:      dnsmessage.Header{Response: true, RCode: header.RCode},
+				Answers:     parsedAnswers,
+				Authorities: proof,
+			}, Server: server}, nil
+
 		}
 
+		/* neither an answer, a denial nor a referral, so say which server sent what instead of guessing */
 		if len(authorities) == 0 {
-			return &dnsmessage.Message{
-				Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
-			}, nil
-		}
-
-		/* Get all the nameserveres*/
-		nameservers := make([]string, len(authorities))
-		for k, authority := range authorities {
-			if authority.Header.Type == dnsmessage.TypeNS {
-				//fmt.Printf("authority.Body.(*dnsmessage.NSResource).NS: %s \n", authority.Body.(*dnsmessage.NSResource).NS)
-				nameservers[k] = authority.Body.(*dnsmessage.NSResource).NS.String()
-				//fmt.Printf("nameserver: %s \n", nameservers[k])
+			return nil, fmt.Errorf("zone %s: server %s sent a non-authoritative %s without answers or a referral for %s",
+				zone, server, rcodeName(header.RCode), question.Name)
+		}
+
+		/* Get all the nameserveres of the zone we are referred to, a referral is for one zone only */
+		referralZone := ""
+		nameservers := []string{}
+		for _, authority := range authorities {
+			if authority.Header.Type != dnsmessage.TypeNS {
+				continue
+			}
+			if referralZone == "" {
+				referralZone = authority.Header.Name.String()
 			}
+			if strings.EqualFold(authority.Header.Name.String(), referralZone) {
+				nameservers = append(nameservers, authority.Body.(*dnsmessage.NSResource).NS.String())
+			}
+		}
+		if len(nameservers) == 0 {
+			return nil, fmt.Errorf("zone %s sent neither an answer nor a referral for %s (%s)", zone, question.Name, header.RCode)
 		}
 
-		/* Get all the additional coresponding to all the authorities */
-		additionals, err := dnsAnswer.AllAdditionals()
-		if err != nil {
+		if err := checkReferral(question.Name.String(), zone, referralZone, visited); err != nil {
 			return nil, err
 		}
+		if referrals >= maxReferrals {
+			return nil, fmt.Errorf("gave up on %s after %d referrals, the last from zone %s to %s", question.Name, referrals, zone, referralZone)
+		}
+		visited[strings.ToLower(referralZone)] = true
+		zone = referralZone
+
+		/* IPv4 glue goes first so IPv6 is only tried when the IPv4 servers fail. Glue outside the
+		   zone we asked was dropped above, those nameservers get looked up on their own below */
 		newResolverServersFound := false
 		servers = []net.IP{} // set servers as empty
+		ipv6Servers := []net.IP{}
 		for _, additional := range additionals {
-			if additional.Header.Type == dnsmessage.TypeA {
-				for _, nameserver := range nameservers {
-					if additional.Header.Name.String() == nameserver {
-						newResolverServersFound = true
-						servers = append(servers, additional.Body.(*dnsmessage.AResource).A[:])
-					} //if
-
-				} //for
+			if !isAddressType(additional.Header.Type) {
+				continue
+			}
+			for _, nameserver := range nameservers {
+				if additional.Header.Name.String() == nameserver {
+					newResolverServersFound = true
+					ip, _ := recordIP(additional.Body)
+					if additional.Header.Type == dnsmessage.TypeAAAA {
+						ipv6Servers = append(ipv6Servers, ip)
+					} else {
+						servers = append(servers, ip)
+					}
+				} //if
 
-			} //if
+			} //for
 
 		} //for
+		servers = append(servers, ipv6Servers...)
 
-		if !newResolverServersFound {
+		/* Without glue the nameservers are resolved like any other name, as A and with -6 also as AAAA */
+		if !newResolverServersFound && depth < maxNameserverDepth {
 			for _, nameserver := range nameservers {
-				if !newResolverServersFound {
-					response, err := dnsQuery(getRootServers(), dnsmessage.Question{Name: dnsmessage.MustNewName(nameserver), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+				// a nameserver inside the zone itself can only be found through that zone, which needs glue
+				if newResolverServersFound || isSubdomain(nameserver, zone) {
+					continue
+				}
+
+				for _, typ := range addressTypes() {
+					response, err := iterativeQuery(ctx, getRootServers(), dnsmessage.Question{Name: dnsmessage.MustNewName(nameserver), Type: typ, Class: dnsmessage.ClassINET}, depth+1)
 					if err != nil {
-						fmt.Printf("warning: lookup of nameserver %s failed: %err\n", nameserver, err)
-					} else {
-						newResolverServersFound = true
-						for _, answer := range response.Answers {
+						fmt.Fprintf(os.Stderr, "warning: lookup of nameserver %s failed: %v\n", nameserver, err)
+						continue
+					}
+					for _, answer := range response.Answers {
+						if answer.Header.Type == typ {
+							ip, _ := recordIP(answer.Body)
+							servers = append(servers, ip)
+							newResolverServersFound = true
+						}
+
+					} //for
 
-							if answer.Header.Type == dnsmessage.TypeA {
-								servers = append(servers, answer.Body.(*dnsmessage.AResource).A[:])
-							}
+				} //for
 
-						} //for
+			} //for
 
-					} //else
+		} //if
 
-				} //if
+		if !newResolverServersFound {
+			return nil, fmt.Errorf("referral %d to zone %s: no address found for any of its nameservers %v", referrals+1, zone, nameservers)
+		}
+	}
+}
 
-			} //for
+// cachedResponse answers question from the cache when we have seen it before.
+// A name or type we already know doesn't exist is answered from the negative cache.
+func cachedResponse(ctx context.Context, depth int, question dnsmessage.Question) (*Response, bool) {
+	if answers, proof, ok := resolverCache.Answers(question); ok {
+		tracef(ctx, depth, ";; %s %s answered from the cache", question.Name, typeName(question.Type))
+		return &Response{Message: dnsmessage.Message{
+			Header:      dnsmessage.Header{Response: true},
+			Answers:     answers,
+			Authorities: proof,
+		}}, true
+	}
 
-		} //if
+	if rcode, soa, ok := resolverCache.Negative(question); ok {
+		tracef(ctx, depth, ";; %s %s is cached as %s", question.Name, typeName(question.Type), rcodeName(rcode))
+		return negativeMessage(rcode, soa), true
+	}
+	return nil, false
+}
 
-		//fmt.Printf("%s", newResolverServersFound)
+// checkReferral makes sure a referral from zone to referralZone is a step
+// down the tree towards name, and not back to a zone we've been at already
+func checkReferral(name, zone, referralZone string, visited map[string]bool) error {
+	switch {
+	case visited[strings.ToLower(referralZone)]:
+		return fmt.Errorf("referral loop: zone %s referred back to %s", zone, referralZone)
+	case !isSubdomain(name, referralZone):
+		return fmt.Errorf("zone %s referred %s to the unrelated zone %s", zone, name, referralZone)
+	case !isSubdomain(referralZone, zone):
+		return fmt.Errorf("zone %s referred to %s, which isn't below it", zone, referralZone)
+	}
+	return nil
+}
+
+// isNegativeResponse reports whether a reply says the name (NXDOMAIN) or the
+// requested type (NODATA) doesn't exist, see RFC 2308 section 2.
+func isNegativeResponse(header *dnsmessage.Header, answers []dnsmessage.Resource, authorities []dnsmessage.Resource) bool {
+	if header.RCode == dnsmessage.RCodeNameError {
+		return true
+	}
+	if header.RCode != dnsmessage.RCodeSuccess || len(answers) > 0 {
+		return false
+	}
 
+	/* an empty answer is a NODATA when it's authoritative or carries a SOA instead of a referral */
+	hasSOA, hasNS := false, false
+	for _, authority := range authorities {
+		switch authority.Header.Type {
+		case dnsmessage.TypeSOA:
+			hasSOA = true
+		case dnsmessage.TypeNS:
+			hasNS = true
+		}
 	}
+	return header.Authoritative || (hasSOA && !hasNS)
+}
 
-	return &dnsmessage.Message{
-		Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure},
-	}, nil
+// negativeMessage builds the reply for a name or type that doesn't exist,
+// keeping only the SOA records of the authority section and the NSEC, NSEC3
+// and RRSIG records DNSSEC uses to prove the denial
+func negativeMessage(rcode dnsmessage.RCode, authorities []dnsmessage.Resource) *Response {
+	soa := []dnsmessage.Resource{}
+	for _, authority := range authorities {
+		switch authority.Header.Type {
+		case dnsmessage.TypeSOA, typeNSEC, typeNSEC3, typeRRSIG:
+			soa = append(soa, authority)
+		}
+	}
 
+	return &Response{Message: dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, RCode: rcode},
+		Authorities: soa,
+	}}
 }
 
-func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Parser, *dnsmessage.Header, error) {
+// denialProof keeps the NSEC and NSEC3 records of an authority section and the
+// RRSIG records over them. Next to a positive answer they prove that the name
+// asked for doesn't exist itself, when the answer was expanded from a wildcard.
+func denialProof(authorities []dnsmessage.Resource) []dnsmessage.Resource {
+	proof := []dnsmessage.Resource{}
+	for _, authority := range authorities {
+		switch authority.Header.Type {
+		case typeNSEC, typeNSEC3:
+			proof = append(proof, authority)
+		case typeRRSIG:
+			if covered := coveredType(authority); covered == typeNSEC || covered == typeNSEC3 {
+				proof = append(proof, authority)
+			}
+		}
+	}
+	return proof
+}
+
+// outgoingDnsQuery asks question to one of the nameservers servers, without
+// asking for recursion. Next to the response it returns the address of the
+// server that sent it.
+func outgoingDnsQuery(ctx context.Context, servers []net.IP, question dnsmessage.Question) (*dnsmessage.Parser, *dnsmessage.Header, string, error) {
+	addresses := make([]string, 0, len(servers))
+	for _, server := range servers {
+		addresses = append(addresses, net.JoinHostPort(server.String(), upstreamPort))
+	}
+	return askServers(ctx, upstreamTransport, addresses, question, false)
+}
+
+// askServers asks question to one of addresses over transport, using EDNS(0)
+// unless it's disabled. recursionDesired sets the RD bit, which only
+// forwarding needs.
+func askServers(ctx context.Context, transport Transport, addresses []string, question dnsmessage.Question, recursionDesired bool) (*dnsmessage.Parser, *dnsmessage.Header, string, error) {
+	useEDNS := ednsBufferSize > 0
+	p, header, server, err := sendDnsQuery(ctx, transport, addresses, question, useEDNS, recursionDesired)
+
+	/* A server that doesn't know EDNS answers FORMERR (RFC 6891 section 7), so ask again in plain DNS */
+	if err == nil && useEDNS && header.RCode == dnsmessage.RCodeFormatError {
+		return sendDnsQuery(ctx, transport, addresses, question, false, recursionDesired)
+	}
+	return p, header, server, err
+}
+
+// sendDnsQuery asks question over transport to the servers at addresses until
+// one of them answers. It starts at a random server and rotates through all of
+// them, queryRetries extra times when every one fails, until ctx runs out.
+// A server answering SERVFAIL or REFUSED is skipped like one that doesn't answer.
+// With useEDNS the query carries an OPT record advertising ednsBufferSize,
+// with the DO bit set under -dnssec. It returns the address of the server
+// that answered along with the answer.
+func sendDnsQuery(ctx context.Context, transport Transport, addresses []string, question dnsmessage.Question, useEDNS bool, recursionDesired bool) (*dnsmessage.Parser, *dnsmessage.Header, string, error) {
+	if len(addresses) == 0 {
+		return nil, nil, "", fmt.Errorf("no servers to ask")
+	}
+
 	/*used for randomly choosing a random number*/
 	max := ^uint16(0)
 	randomNumber, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
+	}
+
+	/* with 0x20 the name goes out in random case, which the answer has to copy */
+	if useCaseRandomization {
+		if question.Name, err = randomizeCase(question.Name); err != nil {
+			return nil, nil, "", err
+		}
 	}
 
 	/* build a new message */
 	message := dnsmessage.Message{
 		Header: dnsmessage.Header{
-			ID:       uint16(randomNumber.Int64()),
-			Response: false,
-			OpCode:   dnsmessage.OpCode(0),
+			ID:               uint16(randomNumber.Int64()),
+			Response:         false,
+			OpCode:           dnsmessage.OpCode(0),
+			RecursionDesired: recursionDesired,
 		},
 		Questions: []dnsmessage.Question{question},
 	}
 
-	/* encode the new message */
-	buf, err := message.Pack()
-	if err != nil {
-		return nil, nil, err
-	}
-
-	/* Find one root server avaiable now */
-	var conn net.Conn
-	for _, server := range servers {
-		conn, err = net.Dial("udp", server.String()+":53")
-		if err == nil {
-			break
+	/* advertise a bigger UDP payload with an OPT pseudo record and size the read buffer to match */
+	bufferSize := maxUDPResponseSize
+	if useEDNS {
+		opt, err := ednsOPT(ednsBufferSize, dnssecEnabled)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		message.Additionals = []dnsmessage.Resource{opt}
+		if int(ednsBufferSize) > bufferSize {
+			bufferSize = int(ednsBufferSize)
 		}
-	}
-	if conn == nil {
-		return nil, nil, fmt.Errorf("failed to make connection to servers: %s", err)
 	}
 
-	/* send the new message to the choosen server */
-	_, err = conn.Write(buf)
+	/* encode the new message */
+	buf, err := message.Pack()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
-	/* receive the answer to the message from the choosen server */
-	answer := make([]byte, 512)
-	n, err := bufio.NewReader(conn).Read(answer)
+	/* Pick a random server to start at, so one dead server isn't always asked first. The
+	   choice is drawn on its own, deriving it from the ID would tell an observer part of the ID */
+	startNumber, err := rand.Int(rand.Reader, big.NewInt(int64(len(addresses))))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
+	start := int(startNumber.Int64())
+	lame := map[string]bool{}
+	for attempt := 0; attempt <= queryRetries; attempt++ {
+		for i := range addresses {
+			address := addresses[(start+i)%len(addresses)]
+			if lame[address] {
+				continue
+			}
+			answer, exchangeErr := transport.Exchange(ctx, address, buf, bufferSize)
+			if exchangeErr == nil {
+				/* whatever the transport, the answer has to belong to our query */
+				p, header, parseErr := parseResponse(answer, message.Header.ID, question)
+				if parseErr == nil && header.RCode != dnsmessage.RCodeServerFailure && header.RCode != dnsmessage.RCodeRefused {
+					return p, header, address, nil
+				}
+				/* a lame or broken server answers SERVFAIL or REFUSED, asking it again won't help */
+				if parseErr == nil {
+					lame[address] = true
+					parseErr = fmt.Errorf("answered %s", rcodeName(header.RCode))
+				}
+				exchangeErr = parseErr
+			}
+			err = fmt.Errorf("%s: %w", address, exchangeErr)
 
-	/* Close the connection */
-	conn.Close()
-
-	//parse the answer
-	var p dnsmessage.Parser
-	/* Get the head part of the answer */
-	header, err := p.Start(answer[:n])
-	if err != nil {
-		return nil, nil, fmt.Errorf("parser start error: %s", err)
+			if ctx.Err() != nil {
+				return nil, nil, "", fmt.Errorf("lookup of %s timed out: %w", question.Name, ctx.Err())
+			}
+		}
 	}
 
-	/* Get the question part of the answer */
-	questions, err := p.AllQuestions()
-	if err != nil {
-		return nil, nil, err
-	}
+	return nil, nil, "", fmt.Errorf("no usable answer from %d servers after %d tries, last error: %w", len(addresses), queryRetries+1, err)
+}
 
-	if len(questions) != len(message.Questions) {
-		return nil, nil, fmt.Errorf("answer packet doesn't have the same amount of questions")
+// attemptDeadline is the moment a single attempt gives up: queryTimeout from
+// now, or the deadline of the whole lookup when that comes first
+func attemptDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(queryTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
 	}
+	return deadline
+}
 
-	return &p, &header, nil
-
+// ednsOPT builds the OPT pseudo record advertising a UDP payload of size bytes.
+// dnssecOK sets the DO bit, asking for the RRSIG records of the answer (RFC 3225).
+func ednsOPT(size uint16, dnssecOK bool) (dnsmessage.Resource, error) {
+	var header dnsmessage.ResourceHeader
+	if err := header.SetEDNS0(int(size), dnsmessage.RCodeSuccess, dnssecOK); err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	return dnsmessage.Resource{Header: header, Body: &dnsmessage.OPTResource{}}, nil
 }
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeHierarchy is an in-process DNS tree for upstreamTransport:
+//
+//	10.0.0.1  root, refers test. with glue and example. without glue
+//	10.0.0.2  test., refers site.test. and example-dns.test., and poison.test.
+//	          with glue outside test. pointing at 6.6.6.6
+//	10.0.0.3  authoritative for site.test., example-dns.test. and example.,
+//	          big.site.test. has 40 addresses, too many for 512 bytes,
+//	          huge.site.test. has 100, too many for 1232 bytes
+//	10.0.0.9  a lame nameserver of site.test. that answers SERVFAIL
+//
+// It counts the queries every server gets.
+type fakeHierarchy struct {
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func (f *fakeHierarchy) count(address string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[address]
+}
+
+func (f *fakeHierarchy) total() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	total := 0
+	for _, n := range f.queries {
+		total += n
+	}
+	return total
+}
+
+// Exchange answers a packed query like the server at address would
+func (f *fakeHierarchy) Exchange(ctx context.Context, address string, query []byte, bufferSize int) ([]byte, error) {
+	f.mu.Lock()
+	f.queries[address]++
+	f.mu.Unlock()
+
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: header.ID, Response: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	name := strings.ToLower(question.Name.String())
+	switch address {
+	case "10.0.0.1:53":
+		switch {
+		case isSubdomain(name, "test."):
+			reply.Authorities = []dnsmessage.Resource{fakeNS("test.", "ns.nic.test.")}
+			reply.Additionals = []dnsmessage.Resource{fakeA("ns.nic.test.", 10, 0, 0, 2)}
+		case isSubdomain(name, "example."):
+			reply.Authorities = []dnsmessage.Resource{fakeNS("example.", "ns.example-dns.test.")}
+		default:
+			reply.Header.RCode = dnsmessage.RCodeNameError
+		}
+
+	case "10.0.0.2:53":
+		switch {
+		case isSubdomain(name, "site.test."):
+			reply.Authorities = []dnsmessage.Resource{fakeNS("site.test.", "ns1.site.test."), fakeNS("site.test.", "ns2.site.test.")}
+			reply.Additionals = []dnsmessage.Resource{fakeA("ns1.site.test.", 10, 0, 0, 3), fakeA("ns2.site.test.", 10, 0, 0, 9)}
+		case isSubdomain(name, "poison.test."):
+			// glue for the nameserver and another name outside test., neither may be trusted
+			reply.Authorities = []dnsmessage.Resource{fakeNS("poison.test.", "ns.elsewhere.example.")}
+			reply.Additionals = []dnsmessage.Resource{fakeA("ns.elsewhere.example.", 6, 6, 6, 6), fakeA("www.example.", 6, 6, 6, 6)}
+		case isSubdomain(name, "example-dns.test."):
+			reply.Authorities = []dnsmessage.Resource{fakeNS("example-dns.test.", "ns.example-dns.test.")}
+			reply.Additionals = []dnsmessage.Resource{fakeA("ns.example-dns.test.", 10, 0, 0, 3)}
+		default:
+			reply.Header.RCode = dnsmessage.RCodeNameError
+		}
+
+	case "10.0.0.3:53":
+		reply.Header.Authoritative = true
+		switch {
+		case name == "www.site.test." && question.Type == dnsmessage.TypeA:
+			reply.Answers = []dnsmessage.Resource{fakeA(name, 192, 0, 2, 10)}
+		case name == "alias.site.test.":
+			reply.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("www.example.")},
+			}}
+		case name == "big.site.test." && question.Type == dnsmessage.TypeA:
+			for i := 1; i <= 40; i++ {
+				reply.Answers = append(reply.Answers, fakeA(name, 192, 0, 2, byte(i)))
+			}
+		case name == "huge.site.test." && question.Type == dnsmessage.TypeA:
+			for i := 1; i <= 100; i++ {
+				reply.Answers = append(reply.Answers, fakeA(name, 192, 0, 2, byte(i)))
+			}
+		case name == "www.poison.test." && question.Type == dnsmessage.TypeA:
+			// the answer of poison.test. slips in a record for site.test.
+			reply.Answers = []dnsmessage.Resource{fakeA(name, 192, 0, 2, 30), fakeA("www.site.test.", 6, 6, 6, 6)}
+		case name == "ns.elsewhere.example." && question.Type == dnsmessage.TypeA:
+			reply.Answers = []dnsmessage.Resource{fakeA(name, 10, 0, 0, 3)}
+		case name == "www.example." && question.Type == dnsmessage.TypeA:
+			reply.Answers = []dnsmessage.Resource{fakeA(name, 192, 0, 2, 20)}
+		case name == "ns.example-dns.test." && question.Type == dnsmessage.TypeA:
+			reply.Answers = []dnsmessage.Resource{fakeA(name, 10, 0, 0, 3)}
+		case name == "www.site.test." || name == "ns.example-dns.test." || name == "www.example." || name == "ns.elsewhere.example.":
+			reply.Authorities = []dnsmessage.Resource{fakeSOA(name)}
+		default:
+			reply.Header.RCode = dnsmessage.RCodeNameError
+			reply.Authorities = []dnsmessage.Resource{fakeSOA(name)}
+		}
+
+	case "10.0.0.9:53":
+		reply.Header.RCode = dnsmessage.RCodeServerFailure
+
+	default:
+		return nil, fmt.Errorf("no server at %s", address)
+	}
+	return reply.Pack()
+}
+
+func fakeA(name string, a, b, c, d byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.AResource{A: [4]byte{a, b, c, d}},
+	}
+}
+
+func fakeNS(zone, nameserver string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(zone), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName(nameserver)},
+	}
+}
+
+// fakeSOA is the SOA of the zone name lies in on 10.0.0.3
+func fakeSOA(name string) dnsmessage.Resource {
+	zone := "site.test."
+	switch {
+	case isSubdomain(name, "example-dns.test."):
+		zone = "example-dns.test."
+	case isSubdomain(name, "example."):
+		zone = "example."
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(zone), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body: &dnsmessage.SOAResource{
+			NS: dnsmessage.MustNewName("ns1." + zone), MBox: dnsmessage.MustNewName("hostmaster." + zone),
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 60,
+		},
+	}
+}
+
+// useUpstream sends every query to a nameserver through transport, with
+// 10.0.0.1 as the only root server and an empty cache, and puts everything
+// back when the test ends
+func useUpstream(t *testing.T, transport Transport) {
+	oldTransport, oldRoots, oldPort, oldCache := upstreamTransport, rootServers, upstreamPort, resolverCache
+	oldForwarders, oldPreferred, oldCase := forwarders, preferredForwarder, useCaseRandomization
+	t.Cleanup(func() {
+		upstreamTransport, rootServers, upstreamPort, resolverCache = oldTransport, oldRoots, oldPort, oldCache
+		forwarders, preferredForwarder, useCaseRandomization = oldForwarders, oldPreferred, oldCase
+	})
+
+	upstreamTransport = transport
+	rootServers = "10.0.0.1"
+	upstreamPort = "53"
+	resolverCache = NewCache()
+	forwarders = nil
+	preferredForwarder = 0
+	useCaseRandomization = false
+}
+
+// useFakeHierarchy points the resolver at a fresh fakeHierarchy
+func useFakeHierarchy(t *testing.T) *fakeHierarchy {
+	fake := &fakeHierarchy{queries: map[string]int{}}
+	useUpstream(t, fake)
+	return fake
+}
+
+func lookupA(t *testing.T, name string) *Response {
+	t.Helper()
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	response, err := lookup(context.Background(), question)
+	if err != nil {
+		t.Fatalf("lookup of %s: %v", name, err)
+	}
+	return response
+}
+
+// answerStrings formats answers as "name TYPE value" for comparing
+func answerStrings(answers []dnsmessage.Resource) []string {
+	formatted := []string{}
+	for _, answer := range answers {
+		value := ""
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			value = fmt.Sprintf("%d.%d.%d.%d", body.A[0], body.A[1], body.A[2], body.A[3])
+		case *dnsmessage.CNAMEResource:
+			value = body.CNAME.String()
+		}
+		formatted = append(formatted, fmt.Sprintf("%s %s %s", answer.Header.Name, typeName(answer.Header.Type), value))
+	}
+	return formatted
+}
+
+func TestIterativeReferrals(t *testing.T) {
+	fake := useFakeHierarchy(t)
+
+	response := lookupA(t, "www.site.test.")
+	if got, want := strings.Join(answerStrings(response.Answers), "; "), "www.site.test. A 192.0.2.10"; got != want {
+		t.Fatalf("answers = %q, want %q", got, want)
+	}
+	if response.Server != "10.0.0.3:53" {
+		t.Errorf("answered by %q, want the authoritative server 10.0.0.3:53", response.Server)
+	}
+	if fake.count("10.0.0.1:53") != 1 || fake.count("10.0.0.2:53") != 1 {
+		t.Errorf("root asked %d times and test. %d times, want once each", fake.count("10.0.0.1:53"), fake.count("10.0.0.2:53"))
+	}
+	if fake.count("10.0.0.9:53") > 1 {
+		t.Errorf("the lame server was asked %d times, want at most once", fake.count("10.0.0.9:53"))
+	}
+
+	/* the delegation of site.test. is cached, so another name in it goes straight to its servers */
+	before := fake.count("10.0.0.1:53") + fake.count("10.0.0.2:53")
+	if _, err := lookup(context.Background(), dnsmessage.Question{Name: dnsmessage.MustNewName("mail.site.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatalf("lookup of mail.site.test.: %v", err)
+	}
+	if after := fake.count("10.0.0.1:53") + fake.count("10.0.0.2:53"); after != before {
+		t.Errorf("the root and test. were asked again for a name in the cached zone site.test.")
+	}
+}
+
+func TestIterativeCNAMEAndGluelessNameserver(t *testing.T) {
+	fake := useFakeHierarchy(t)
+
+	/* www.example. is only reachable through ns.example-dns.test., which the root gives no glue for */
+	response := lookupA(t, "alias.site.test.")
+	want := "alias.site.test. CNAME www.example.; www.example. A 192.0.2.20"
+	if got := strings.Join(answerStrings(response.Answers), "; "); got != want {
+		t.Fatalf("answers = %q, want %q", got, want)
+	}
+	if fake.count("10.0.0.1:53") < 2 {
+		t.Errorf("root asked %d times, want once for site.test. and again for example. and its nameserver", fake.count("10.0.0.1:53"))
+	}
+}
+
+func TestIterativeNegativeCaching(t *testing.T) {
+	fake := useFakeHierarchy(t)
+
+	for i := 0; i < 2; i++ {
+		response := lookupA(t, "missing.site.test.")
+		if response.Header.RCode != dnsmessage.RCodeNameError {
+			t.Fatalf("lookup %d: rcode %s, want NXDOMAIN", i+1, rcodeName(response.Header.RCode))
+		}
+		if len(response.Authorities) != 1 || response.Authorities[0].Header.Type != dnsmessage.TypeSOA {
+			t.Errorf("lookup %d: authorities %v, want the SOA of site.test.", i+1, response.Authorities)
+		}
+	}
+
+	/* NODATA: www.site.test. exists, but has no AAAA */
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("www.site.test."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}
+	for i := 0; i < 2; i++ {
+		response, err := lookup(context.Background(), question)
+		if err != nil {
+			t.Fatalf("AAAA lookup %d: %v", i+1, err)
+		}
+		if response.Header.RCode != dnsmessage.RCodeSuccess || len(response.Answers) != 0 {
+			t.Fatalf("AAAA lookup %d: rcode %s with %d answers, want an empty NOERROR", i+1, rcodeName(response.Header.RCode), len(response.Answers))
+		}
+	}
+
+	queries := fake.total()
+	lookupA(t, "missing.site.test.")
+	if _, err := lookup(context.Background(), question); err != nil {
+		t.Fatal(err)
+	}
+	if fake.total() != queries {
+		t.Errorf("cached NXDOMAIN and NODATA answers went to the network again")
+	}
+}
+
+func TestIterativeUnreachableRoot(t *testing.T) {
+	var asked int32
+	useUpstream(t, TransportFunc(func(ctx context.Context, address string, query []byte, bufferSize int) ([]byte, error) {
+		atomic.AddInt32(&asked, 1)
+		return nil, fmt.Errorf("connection refused")
+	}))
+
+	_, err := lookup(context.Background(), testQuestion(t, "www.site.test."))
+	if err == nil || !strings.Contains(err.Error(), "zone .") || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("got %v, want the error of the root servers", err)
+	}
+	if got := atomic.LoadInt32(&asked); got != int32(queryRetries+1) {
+		t.Errorf("the root was asked %d times, want %d", got, queryRetries+1)
+	}
+}
+
+// fakeServer is a Transport for tests that need a hierarchy of their own.
+// answer fills in the reply of the server at address to question.
+func fakeServer(answer func(address string, question dnsmessage.Question, reply *dnsmessage.Message)) Transport {
+	return TransportFunc(func(ctx context.Context, address string, query []byte, bufferSize int) ([]byte, error) {
+		var p dnsmessage.Parser
+		header, err := p.Start(query)
+		if err != nil {
+			return nil, err
+		}
+		question, err := p.Question()
+		if err != nil {
+			return nil, err
+		}
+		reply := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: header.ID, Response: true},
+			Questions: []dnsmessage.Question{question},
+		}
+		answer(address, question, &reply)
+		return reply.Pack()
+	})
+}
+
+// referral makes reply refer to zone, served by ns.<zone> at ip
+func referral(reply *dnsmessage.Message, zone string, ip byte) {
+	reply.Authorities = []dnsmessage.Resource{fakeNS(zone, "ns."+zone)}
+	reply.Additionals = []dnsmessage.Resource{fakeA("ns."+zone, 10, 0, 0, ip)}
+}
+
+func TestIterativeBadReferrals(t *testing.T) {
+	tests := []struct {
+		name string
+		tld  func(reply *dnsmessage.Message) // how 10.0.0.2, the server of test., answers
+		want string
+	}{
+		{"loop to the same zone", func(reply *dnsmessage.Message) { referral(reply, "test.", 2) }, "referral loop"},
+		// NS records for the root are out of the bailiwick of test., so nothing is left of the referral
+		{"back up to the root", func(reply *dnsmessage.Message) {
+			reply.Authorities = []dnsmessage.Resource{fakeNS(".", "ns.test.")}
+			reply.Additionals = []dnsmessage.Resource{fakeA("ns.test.", 10, 0, 0, 1)}
+		}, "without answers or a referral"},
+		{"sideways", func(reply *dnsmessage.Message) { referral(reply, "other.test.", 3) }, "unrelated zone"},
+	}
+	for _, test := range tests {
+		var asked int32
+		useUpstream(t, fakeServer(func(address string, question dnsmessage.Question, reply *dnsmessage.Message) {
+			atomic.AddInt32(&asked, 1)
+			switch address {
+			case "10.0.0.1:53":
+				referral(reply, "test.", 2)
+			case "10.0.0.2:53":
+				test.tld(reply)
+			default:
+				t.Errorf("%s: the resolver followed the bad referral to %s", test.name, address)
+				reply.Header.RCode = dnsmessage.RCodeRefused
+			}
+		}))
+
+		_, err := lookup(context.Background(), testQuestion(t, "www.site.test."))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error about a %s", test.name, err, test.want)
+		}
+		if got := atomic.LoadInt32(&asked); got != 2 {
+			t.Errorf("%s: %d queries, want one to the root and one to test.", test.name, got)
+		}
+	}
+}
+
+func TestIterativeMaxReferrals(t *testing.T) {
+	defer func(old int) { maxReferrals = old }(maxReferrals)
+	maxReferrals = 2
+
+	/* the server at 10.0.0.N refers to the zone of the last N labels of the name, one deeper each time */
+	name := "a.b.c.d.e.test."
+	useUpstream(t, fakeServer(func(address string, question dnsmessage.Question, reply *dnsmessage.Message) {
+		depth := int(net.ParseIP(strings.TrimSuffix(address, ":53")).To4()[3])
+		labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+		zone := strings.Join(labels[len(labels)-depth:], ".") + "."
+		referral(reply, zone, byte(depth+1))
+	}))
+
+	_, err := lookup(context.Background(), testQuestion(t, name))
+	if err == nil || !strings.Contains(err.Error(), "after 2 referrals") {
+		t.Fatalf("got %v, want the walk to give up after 2 referrals", err)
+	}
+}
+
+func TestIterativeIgnoresOutOfBailiwickRecords(t *testing.T) {
+	fake := useFakeHierarchy(t)
+
+	response := lookupA(t, "www.poison.test.")
+	if got, want := strings.Join(answerStrings(response.Answers), "; "), "www.poison.test. A 192.0.2.30"; got != want {
+		t.Fatalf("answers = %q, want %q", got, want)
+	}
+	if fake.count("6.6.6.6:53") != 0 {
+		t.Errorf("the out of bailiwick glue 6.6.6.6 was asked")
+	}
+	if fake.count("10.0.0.3:53") < 2 {
+		t.Errorf("ns.elsewhere.example. wasn't looked up on its own")
+	}
+
+	/* neither the stray glue nor the stray answer made it into the cache */
+	for _, name := range []string{"www.example.", "www.site.test."} {
+		if records, ok := resolverCache.Get(name, dnsmessage.TypeA, dnsmessage.ClassINET); ok {
+			t.Errorf("%s was cached from another zone: %v", name, answerStrings(records))
+		}
+	}
+	if got := strings.Join(answerStrings(lookupA(t, "www.site.test.").Answers), "; "); got != "www.site.test. A 192.0.2.10" {
+		t.Errorf("www.site.test. resolved to %q", got)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// outputFormat is set with -o. text prints the name,value lines people read,
+// csv and json are meant for other programs.
+var outputFormat = "text"
+
+// csvHeader names the columns of -o csv
+var csvHeader = []string{"name", "type", "ttl", "value", "rcode", "dnssec", "error"}
+
+// lookupResult is everything resolve found out about one name
+type lookupResult struct {
+	typ       dnsmessage.Type
+	values    []string  // the values the text output prints
+	response  *Response // nil when the lookup failed
+	status    string    // the DNSSEC status with -dnssec
+	statusErr error     // why the DNSSEC status is bogus
+	trace     []string  // the steps of the walk with -trace
+	err       error
+}
+
+// jsonResult is the object -o json prints for every name
+type jsonResult struct {
+	Name    string       `json:"name"`
+	Type    string       `json:"type"`
+	RCode   string       `json:"rcode,omitempty"`
+	Server  string       `json:"server,omitempty"`
+	Answers []jsonRecord `json:"answers"`
+	DNSSEC  string       `json:"dnssec,omitempty"`
+	Trace   []string     `json:"trace,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// jsonRecord is one record of the answer in -o json
+type jsonRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl"`
+	Value string `json:"value"`
+}
+
+// formatResult turns the result for name into the lines to print in the
+// format chosen with -o. with all the text format prints every value.
+func formatResult(name string, result lookupResult, all bool) []string {
+	switch outputFormat {
+	case "csv":
+		return formatCSV(name, result)
+	case "json":
+		return formatJSON(name, result)
+	}
+	return formatText(name, result, all)
+}
+
+// formatText prints name,value. Errors go on their own line before it, and
+// with -trace the steps of the walk before those.
+func formatText(name string, result lookupResult, all bool) []string {
+	lines := append([]string{}, result.trace...)
+	if result.err != nil {
+		lines = append(lines, fmt.Sprintf("Error %v", result.err))
+	}
+	if result.statusErr != nil {
+		lines = append(lines, fmt.Sprintf("DNSSEC validation of %s record for %s failed: %v", typeName(result.typ), name, result.statusErr))
+	}
+
+	/* with -dnssec every value ends with the status of the answer */
+	values := result.values
+	if result.status != "" {
+		if len(values) == 0 {
+			values = []string{""}
+		}
+		for i := range values {
+			values[i] += "," + result.status
+		}
+	}
+
+	if !all || len(values) == 0 {
+		return append(lines, name+","+strings.Join(values, ""))
+	}
+
+	// with -all every record gets its own name,value line
+	for _, value := range values {
+		lines = append(lines, name+","+value)
+	}
+	return lines
+}
+
+// formatCSV prints one row for every record of the answer, RRSIGs left out.
+// A name without records still gets a row with its rcode or error.
+func formatCSV(name string, result lookupResult) []string {
+	rows := [][]string{}
+	rcode, errText := "", ""
+	if result.err != nil {
+		errText = result.err.Error()
+	} else if result.statusErr != nil {
+		errText = result.statusErr.Error()
+	}
+	if result.response != nil {
+		rcode = rcodeName(result.response.Header.RCode)
+		for _, answer := range result.response.Answers {
+			if answer.Header.Type == typeRRSIG {
+				continue
+			}
+			rows = append(rows, []string{name, typeName(answer.Header.Type), fmt.Sprint(answer.Header.TTL),
+				recordValue(answer.Body), rcode, result.status, errText})
+		}
+	}
+	if len(rows) == 0 {
+		rows = append(rows, []string{name, resultType(result), "", "", rcode, result.status, errText})
+	}
+
+	return csvLines(rows...)
+}
+
+// csvLines quotes rows the way encoding/csv does, one line per row
+func csvLines(rows ...[]string) []string {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.WriteAll(rows)
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+// formatJSON prints one JSON object per name on a single line, so the output
+// can be read line by line as it comes in
+func formatJSON(name string, result lookupResult) []string {
+	output := jsonResult{
+		Name:    name,
+		Type:    resultType(result),
+		Answers: []jsonRecord{},
+		DNSSEC:  result.status,
+	}
+	// the blank lines between the steps only matter to people reading the text output
+	for _, line := range result.trace {
+		if line != "" {
+			output.Trace = append(output.Trace, line)
+		}
+	}
+	if result.response != nil {
+		output.RCode = rcodeName(result.response.Header.RCode)
+		output.Server = result.response.Server
+		for _, answer := range result.response.Answers {
+			output.Answers = append(output.Answers, jsonRecord{
+				Name:  displayName(answer.Header.Name),
+				Type:  typeName(answer.Header.Type),
+				TTL:   answer.Header.TTL,
+				Value: recordValue(answer.Body),
+			})
+		}
+	}
+	if result.err != nil {
+		output.Error = result.err.Error()
+	} else if result.statusErr != nil {
+		output.Error = result.statusErr.Error()
+	}
+
+	line, err := json.Marshal(output)
+	if err != nil {
+		return []string{fmt.Sprintf(`{"name":%q,"error":%q}`, name, err)}
+	}
+	return []string{string(line)}
+}
+
+// resultType is the type that was asked for, empty when the input named no valid type
+func resultType(result lookupResult) string {
+	if result.typ == 0 {
+		return ""
+	}
+	return typeName(result.typ)
+}
+
+// rcodeName prints an rcode the way dig does
+func rcodeName(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return strings.TrimPrefix(rcode.String(), "RCode")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// outputResponse is an answer with an A record, a TXT record that needs
+// quoting in CSV, and an RRSIG
+func outputResponse() *Response {
+	txt := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.TXTResource{TXT: []string{`say "hi", `, "world"}},
+	}
+	return &Response{
+		Message: dnsmessage.Message{
+			Header:  dnsmessage.Header{Response: true},
+			Answers: []dnsmessage.Resource{fakeA("www.example.com.", 192, 0, 2, 1), txt, fakeRRSIG("www.example.com.", dnsmessage.TypeA)},
+		},
+		Server: "10.0.0.3:53",
+	}
+}
+
+func TestFormatResult(t *testing.T) {
+	defer func(old string) { outputFormat = old }(outputFormat)
+	failed := fmt.Errorf("asking the servers of zone com.: timeout, then refused")
+
+	tests := []struct {
+		name   string
+		format string
+		result lookupResult
+		all    bool
+		want   []string
+	}{
+		{"text", "text", lookupResult{typ: dnsmessage.TypeA, values: []string{"192.0.2.1"}}, false,
+			[]string{"www.example.com,192.0.2.1"}},
+		{"text with -all", "text", lookupResult{typ: dnsmessage.TypeA, values: []string{"192.0.2.1", "192.0.2.2"}}, true,
+			[]string{"www.example.com,192.0.2.1", "www.example.com,192.0.2.2"}},
+		{"text with -dnssec", "text", lookupResult{typ: dnsmessage.TypeA, values: []string{"192.0.2.1"}, status: statusSecure}, false,
+			[]string{"www.example.com,192.0.2.1,secure"}},
+		{"text with an error", "text", lookupResult{typ: dnsmessage.TypeA, err: failed}, false,
+			[]string{"Error " + failed.Error(), "www.example.com,"}},
+		{"text with -trace", "text", lookupResult{typ: dnsmessage.TypeA, values: []string{"192.0.2.1"}, trace: []string{";; step 1", ""}}, false,
+			[]string{";; step 1", "", "www.example.com,192.0.2.1"}},
+
+		{"csv quotes values with commas and quotes", "csv", lookupResult{typ: dnsmessage.TypeA, response: outputResponse(), status: statusSecure}, false, []string{
+			"www.example.com,A,300,192.0.2.1,NOERROR,secure,",
+			`www.example.com,TXT,60,"say ""hi"", world",NOERROR,secure,`,
+		}},
+		{"csv without records", "csv", lookupResult{typ: dnsmessage.TypeAAAA, response: &Response{Message: dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}}}}, false,
+			[]string{"www.example.com,AAAA,,,NXDOMAIN,,"}},
+		{"csv with an error", "csv", lookupResult{typ: dnsmessage.TypeA, err: failed}, false,
+			[]string{`www.example.com,A,,,,,"asking the servers of zone com.: timeout, then refused"`}},
+		{"csv without a valid type", "csv", lookupResult{err: fmt.Errorf("record type HINFO doesn't exist")}, false,
+			[]string{"www.example.com,,,,,,record type HINFO doesn't exist"}},
+	}
+	for _, test := range tests {
+		outputFormat = test.format
+		got := formatResult("www.example.com", test.result, test.all)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestFormatResultJSON(t *testing.T) {
+	defer func(old string) { outputFormat = old }(outputFormat)
+	outputFormat = "json"
+
+	tests := []struct {
+		name   string
+		result lookupResult
+		want   string
+	}{
+		{"answer", lookupResult{typ: dnsmessage.TypeA, response: outputResponse(), status: statusSecure, trace: []string{";; step 1", ""}},
+			`{"name":"www.example.com","type":"A","rcode":"NOERROR","server":"10.0.0.3:53","answers":[` +
+				`{"name":"www.example.com","type":"A","ttl":300,"value":"192.0.2.1"},` +
+				`{"name":"www.example.com","type":"TXT","ttl":60,"value":"say \"hi\", world"},` +
+				`{"name":"www.example.com","type":"RRSIG","ttl":300,"value":"\\# 4 00010d02"}],` +
+				`"dnssec":"secure","trace":[";; step 1"]}`},
+		// a failed lookup still has an answers array, so consumers don't have to check for null
+		{"error", lookupResult{typ: dnsmessage.TypeA, err: fmt.Errorf("timeout")},
+			`{"name":"www.example.com","type":"A","answers":[],"error":"timeout"}`},
+		{"bogus", lookupResult{typ: dnsmessage.TypeA, response: &Response{}, status: statusBogus, statusErr: fmt.Errorf("no signatures")},
+			`{"name":"www.example.com","type":"A","rcode":"NOERROR","answers":[],"dnssec":"bogus","error":"no signatures"}`},
+	}
+	for _, test := range tests {
+		lines := formatResult("www.example.com", test.result, false)
+		if len(lines) != 1 {
+			t.Errorf("%s: %d lines, want one object on one line", test.name, len(lines))
+			continue
+		}
+		if lines[0] != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, lines[0], test.want)
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[0]), &decoded); err != nil {
+			t.Errorf("%s: not JSON: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsmessage has no CAA type (RFC 8659), so CAA records arrive as UnknownResource
+const typeCAA dnsmessage.Type = 257
+
+// recordIP returns the address of an A or AAAA record. net.IP.String gives
+// the canonical text form, dotted for IPv4 and RFC 5952 for IPv6.
+func recordIP(body dnsmessage.ResourceBody) (net.IP, bool) {
+	switch record := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(record.A[:]), true
+	case *dnsmessage.AAAAResource:
+		return net.IP(record.AAAA[:]), true
+	}
+	return nil, false
+}
+
+// recordTarget returns the name an NS or CNAME record points to
+func recordTarget(body dnsmessage.ResourceBody) (dnsmessage.Name, bool) {
+	switch record := body.(type) {
+	case *dnsmessage.NSResource:
+		return record.NS, true
+	case *dnsmessage.CNAMEResource:
+		return record.CNAME, true
+	}
+	return dnsmessage.Name{}, false
+}
+
+// recordText returns the text of a TXT record. A long text is split over
+// several strings of at most 255 bytes on the wire, so they are joined back.
+func recordText(body dnsmessage.ResourceBody) (string, bool) {
+	record, ok := body.(*dnsmessage.TXTResource)
+	if !ok {
+		return "", false
+	}
+	return strings.Join(record.TXT, ""), true
+}
+
+// displayName prints a name the way people write it, without the final dot
+func displayName(name dnsmessage.Name) string {
+	if s := name.String(); s != "." {
+		return strings.TrimSuffix(s, ".")
+	}
+	return "."
+}
+
+// formatRecord prints an MX, SOA, PTR, SRV or CAA record in the presentation
+// format of a zone file, without the owner, TTL, class and type
+func formatRecord(body dnsmessage.ResourceBody) (string, bool) {
+	switch record := body.(type) {
+	case *dnsmessage.MXResource:
+		return formatMX(record), true
+	case *dnsmessage.SOAResource:
+		return formatSOA(record), true
+	case *dnsmessage.PTRResource:
+		return formatPTR(record), true
+	case *dnsmessage.SRVResource:
+		return formatSRV(record), true
+	case *dnsmessage.UnknownResource:
+		if record.Type == typeCAA {
+			return formatCAA(record)
+		}
+	}
+	return "", false
+}
+
+// formatMX prints "preference exchange", for example "10 mail.example.com"
+func formatMX(record *dnsmessage.MXResource) string {
+	return fmt.Sprintf("%d %s", record.Pref, displayName(record.MX))
+}
+
+// formatSOA prints "mname rname serial refresh retry expire minimum"
+func formatSOA(record *dnsmessage.SOAResource) string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", displayName(record.NS), displayName(record.MBox),
+		record.Serial, record.Refresh, record.Retry, record.Expire, record.MinTTL)
+}
+
+// formatPTR prints the name an address points back to
+func formatPTR(record *dnsmessage.PTRResource) string {
+	return displayName(record.PTR)
+}
+
+// formatSRV prints "priority weight port target", for example "10 5 5060 sip.example.com"
+func formatSRV(record *dnsmessage.SRVResource) string {
+	return fmt.Sprintf("%d %d %d %s", record.Priority, record.Weight, record.Port, displayName(record.Target))
+}
+
+// formatCAA decodes the raw CAA data (RFC 8659 section 4.1), one flags byte,
+// the tag length, the tag and the value, and prints `flags tag "value"`
+func formatCAA(record *dnsmessage.UnknownResource) (string, bool) {
+	data := record.Data
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return "", false
+	}
+	flags, tag, value := data[0], data[2:2+int(data[1])], data[2+int(data[1]):]
+	return fmt.Sprintf("%d %s %s", flags, tag, strconv.Quote(string(value))), true
+}
+
+// recordValue prints the data of any record. Types without a formatter of
+// their own use the generic form of RFC 3597 section 5, `\# length hexdata`.
+func recordValue(body dnsmessage.ResourceBody) string {
+	if ip, ok := recordIP(body); ok {
+		return ip.String()
+	}
+	if target, ok := recordTarget(body); ok {
+		return displayName(target)
+	}
+	if text, ok := recordText(body); ok {
+		return text
+	}
+	if value, ok := formatRecord(body); ok {
+		return value
+	}
+	if record, ok := body.(*dnsmessage.UnknownResource); ok {
+		return fmt.Sprintf("\\# %d %x", len(record.Data), record.Data)
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// reverseName builds the name whose PTR record holds the hostname of an IP
+// address: 93.184.216.34 becomes 34.216.184.93.in-addr.arpa (RFC 1035
+// section 3.5) and IPv6 addresses get one label per nibble under ip6.arpa
+// (RFC 3596 section 2.5). Like the names given on the command line, the
+// result has no trailing dot.
+func reverseName(address string) (string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", fmt.Errorf("%s is not an IPv4 or IPv6 address", address)
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0]), nil
+	}
+
+	/* least significant nibble first, so walk the 16 bytes backwards */
+	labels := make([]string, 0, 2*net.IPv6len+1)
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		labels = append(labels, strconv.FormatUint(uint64(ip[i]&0x0f), 16), strconv.FormatUint(uint64(ip[i]>>4), 16))
+	}
+	labels = append(labels, "ip6.arpa")
+	return strings.Join(labels, "."), nil
+}
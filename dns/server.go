@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// plain DNS over UDP can't carry more than 512 bytes (RFC 1035 section 4.2.1)
+	maxUDPResponseSize = 512
+	// over TCP the 2 byte length prefix is the only limit
+	maxTCPResponseSize = 65535
+	// a TCP client that stays quiet for this long gets disconnected
+	tcpIdleTimeout = 10 * time.Second
+	// the UDP payload size the server advertises to EDNS(0) clients
+	serverBufferSize = 1232
+	// the biggest UDP query the server reads, a question and an OPT record fit easily
+	maxUDPQuerySize = 512
+	// how many UDP queries are resolved at the same time, more wait until one finishes
+	maxUDPInFlight = 256
+)
+
+// serve runs the recursive resolver as a DNS server on address, over UDP and
+// TCP at the same time. It only returns when one of the listeners fails.
+func serve(address string) error {
+	udpConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer udpConn.Close()
+
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer tcpListener.Close()
+
+	errs := make(chan error, 2)
+	go func() { errs <- serveUDP(udpConn) }()
+	go func() { errs <- serveTCP(tcpListener) }()
+	return <-errs
+}
+
+// serveUDP answers every datagram in its own goroutine so one slow lookup
+// doesn't hold up the others. At most maxUDPInFlight lookups run at once, so
+// a flood of queries can't start an unbounded number of them.
+func serveUDP(conn net.PacketConn) error {
+	inFlight := make(chan struct{}, maxUDPInFlight)
+	buf := make([]byte, maxUDPQuerySize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		/* the buffer is reused for the next datagram, so the goroutine gets its own copy */
+		query := append([]byte(nil), buf[:n]...)
+
+		inFlight <- struct{}{}
+		go func(query []byte, addr net.Addr) {
+			defer func() { <-inFlight }()
+			response, err := handleQuery(query, maxUDPResponseSize)
+			if err != nil {
+				log.Printf("dropping query from %s: %v", addr, err)
+				return
+			}
+			if _, err := conn.WriteTo(response, addr); err != nil {
+				log.Printf("failed to answer %s: %v", addr, err)
+			}
+		}(query, addr)
+	}
+}
+
+func serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn answers queries on one connection until the client closes it
+// or stays idle for too long. A client may send several queries in a row.
+func serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+
+		response, err := handleQuery(query, maxTCPResponseSize)
+		if err != nil {
+			log.Printf("dropping query from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if err := writeTCPMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// handleQuery parses a packed query, resolves it through lookup and packs the
+// response. Responses bigger than maxSize, or than the payload size the client
+// advertised with EDNS(0), are truncated and get the TC bit so the client knows
+// to retry over TCP. Only queries too broken to even carry a header are
+// answered with an error instead of a response.
+func handleQuery(query []byte, maxSize int) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, fmt.Errorf("parser start error: %s", err)
+	}
+	if header.Response {
+		return nil, fmt.Errorf("message is a response, not a query")
+	}
+
+	/* we always recurse, so RA is set on every response */
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+	}
+
+	questions, err := p.AllQuestions()
+	dnssecOK := false
+	if err == nil {
+		/* an OPT record from the client lets the response grow past 512 bytes, and gets one back */
+		var opt *dnsmessage.Resource
+		opt, err = clientOPT(&p)
+		if err == nil && opt != nil {
+			// but never past what we advertise ourselves, big UDP replies fragment and amplify spoofed queries
+			if size := int(opt.Header.Class); size > maxSize {
+				maxSize = size
+				if maxSize > serverBufferSize {
+					maxSize = serverBufferSize
+				}
+			}
+			// the DO bit is copied into the response (RFC 3225 section 3)
+			dnssecOK = opt.Header.DNSSECAllowed()
+			reply, optErr := ednsOPT(serverBufferSize, dnssecOK)
+			if optErr != nil {
+				return nil, optErr
+			}
+			response.Additionals = []dnsmessage.Resource{reply}
+		}
+	}
+
+	switch {
+	case err != nil:
+		response.Header.RCode = dnsmessage.RCodeFormatError
+	case header.OpCode != 0:
+		// only standard queries are supported
+		response.Header.RCode = dnsmessage.RCodeNotImplemented
+	case len(questions) != 1:
+		// nobody supports more than one question per message
+		response.Header.RCode = dnsmessage.RCodeFormatError
+	default:
+		response.Questions = questions
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		result, err := lookup(ctx, questions[0])
+		cancel()
+		if err != nil {
+			log.Printf("lookup of %s %s failed: %v", questions[0].Name, questions[0].Type, err)
+			response.Header.RCode = dnsmessage.RCodeServerFailure
+		} else {
+			response.Header.RCode = result.Header.RCode
+			// we are only authoritative for answers made entirely of local zone data
+			response.Header.Authoritative = result.Local
+			response.Answers = result.Answers
+			response.Authorities = result.Authorities
+			validateForClient(questions[0], &response, result.Local, dnssecOK)
+		}
+	}
+
+	return packResponse(&response, maxSize)
+}
+
+// validateForClient applies -dnssec to a response the way validating resolvers
+// do: a bogus answer becomes SERVFAIL and a secure one gets the AD bit. RRSIG
+// records are only passed on to clients that set the DO bit. local says the
+// response holds nothing but local zone data.
+func validateForClient(question dnsmessage.Question, response *dnsmessage.Message, local bool, dnssecOK bool) {
+	if dnssecEnabled {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		status, err := validateResponse(ctx, question, &Response{Message: *response, Local: local})
+		cancel()
+		switch status {
+		case statusBogus:
+			log.Printf("DNSSEC validation of %s %s failed: %v", question.Name, typeName(question.Type), err)
+			response.Header.RCode = dnsmessage.RCodeServerFailure
+			response.Answers, response.Authorities = nil, nil
+			return
+		case statusSecure:
+			response.Header.AuthenticData = true
+		}
+	}
+
+	if !dnssecOK {
+		response.Answers = withoutSignatures(response.Answers)
+		response.Authorities = withoutSignatures(response.Authorities)
+	}
+}
+
+// withoutSignatures drops the DNSSEC records a client didn't ask for
+func withoutSignatures(resources []dnsmessage.Resource) []dnsmessage.Resource {
+	kept := []dnsmessage.Resource{}
+	for _, resource := range resources {
+		switch resource.Header.Type {
+		case typeRRSIG, typeNSEC, typeNSEC3:
+			continue
+		}
+		kept = append(kept, resource)
+	}
+	return kept
+}
+
+// packResponse packs response, dropping all records and setting the TC bit
+// when the result doesn't fit in maxSize bytes
+func packResponse(response *dnsmessage.Message, maxSize int) ([]byte, error) {
+	buf, err := response.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) <= maxSize {
+		return buf, nil
+	}
+
+	/* the OPT record stays, it tells the client what payload size to use on the retry */
+	response.Header.Truncated = true
+	response.Answers = nil
+	response.Authorities = nil
+	additionals := []dnsmessage.Resource{}
+	for _, additional := range response.Additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT {
+			additionals = append(additionals, additional)
+		}
+	}
+	response.Additionals = additionals
+	return response.Pack()
+}
+
+// clientOPT returns the OPT record of a query whose parser is positioned after
+// the question section, or nil when the client doesn't speak EDNS(0)
+func clientOPT(p *dnsmessage.Parser) (*dnsmessage.Resource, error) {
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, err
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, additional := range additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT {
+			return &additional, nil
+		}
+	}
+	return nil, nil
+}
+
+// readTCPMessage reads one DNS message behind its 2 byte length prefix (RFC 1035 section 4.2.2)
+func readTCPMessage(conn io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeTCPMessage writes msg behind its 2 byte length prefix (RFC 1035 section 4.2.2)
+func writeTCPMessage(conn io.Writer, msg []byte) error {
+	if len(msg) > maxTCPResponseSize {
+		return fmt.Errorf("message of %d bytes is too big for TCP", len(msg))
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := conn.Write(buf)
+	return err
+}
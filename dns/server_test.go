@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// clientQuery packs a query the way a stub resolver sends it, with RD set.
+// ednsSize adds an OPT record advertising that payload size when it isn't 0.
+func clientQuery(t *testing.T, id uint16, questions []dnsmessage.Question, ednsSize uint16) []byte {
+	t.Helper()
+	message := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: questions,
+	}
+	if ednsSize > 0 {
+		opt, err := ednsOPT(ednsSize, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message.Additionals = []dnsmessage.Resource{opt}
+	}
+	packed, err := message.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func unpackResponse(t *testing.T, packed []byte) dnsmessage.Message {
+	t.Helper()
+	var message dnsmessage.Message
+	if err := message.Unpack(packed); err != nil {
+		t.Fatalf("unpacking the response: %v", err)
+	}
+	return message
+}
+
+func TestHandleQuery(t *testing.T) {
+	useFakeHierarchy(t)
+	question := testQuestion(t, "www.site.test.")
+
+	packed, err := handleQuery(clientQuery(t, 4242, []dnsmessage.Question{question}, 0), maxUDPResponseSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := unpackResponse(t, packed)
+	if response.Header.ID != 4242 || !response.Header.Response {
+		t.Errorf("header %+v, want a response with ID 4242", response.Header)
+	}
+	if !response.Header.RecursionAvailable || !response.Header.RecursionDesired {
+		t.Errorf("RA %v and RD %v, want both set", response.Header.RecursionAvailable, response.Header.RecursionDesired)
+	}
+	if response.Header.Authoritative {
+		t.Errorf("AA set on an answer that came from upstream")
+	}
+	if len(response.Questions) != 1 || response.Questions[0] != question {
+		t.Errorf("questions %v, want %v echoed", response.Questions, question)
+	}
+	if response.Header.RCode != dnsmessage.RCodeSuccess || len(response.Answers) != 1 {
+		t.Errorf("rcode %s with %d answers, want NOERROR with 1", rcodeName(response.Header.RCode), len(response.Answers))
+	}
+
+	/* names that don't exist are passed on as NXDOMAIN with the SOA */
+	packed, err = handleQuery(clientQuery(t, 7, []dnsmessage.Question{testQuestion(t, "missing.site.test.")}, 0), maxUDPResponseSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := unpackResponse(t, packed); response.Header.RCode != dnsmessage.RCodeNameError || len(response.Authorities) != 1 {
+		t.Errorf("rcode %s with %d authorities, want NXDOMAIN with the SOA", rcodeName(response.Header.RCode), len(response.Authorities))
+	}
+}
+
+func TestHandleQueryFormatError(t *testing.T) {
+	useFakeHierarchy(t)
+
+	tests := map[string][]dnsmessage.Question{
+		"no questions":  nil,
+		"two questions": {testQuestion(t, "www.site.test."), testQuestion(t, "big.site.test.")},
+	}
+	for name, questions := range tests {
+		packed, err := handleQuery(clientQuery(t, 99, questions, 0), maxUDPResponseSize)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		response := unpackResponse(t, packed)
+		if response.Header.RCode != dnsmessage.RCodeFormatError || response.Header.ID != 99 || !response.Header.RecursionAvailable {
+			t.Errorf("%s: got %+v, want FORMERR for ID 99 with RA", name, response.Header)
+		}
+	}
+
+	/* responses and garbage aren't answered at all */
+	response := dnsmessage.Message{Header: dnsmessage.Header{ID: 1, Response: true}}
+	packed, err := response.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, query := range map[string][]byte{"response": packed, "garbage": {1, 2, 3}} {
+		if _, err := handleQuery(query, maxUDPResponseSize); err == nil {
+			t.Errorf("%s: answered", name)
+		}
+	}
+}
+
+func TestHandleQueryTruncation(t *testing.T) {
+	useFakeHierarchy(t)
+
+	tests := []struct {
+		name      string
+		question  string
+		ednsSize  uint16
+		maxSize   int
+		answers   int
+		truncated bool
+	}{
+		{"UDP", "big.site.test.", 0, maxUDPResponseSize, 40, true},
+		{"UDP with EDNS", "big.site.test.", 1232, maxUDPResponseSize, 40, false},
+		{"TCP", "big.site.test.", 0, maxTCPResponseSize, 40, false},
+		// a client can't raise the UDP limit past the server's own buffer size
+		{"UDP with EDNS 65535", "huge.site.test.", 65535, maxUDPResponseSize, 100, true},
+		{"TCP with EDNS 65535", "huge.site.test.", 65535, maxTCPResponseSize, 100, false},
+	}
+	for _, test := range tests {
+		questions := []dnsmessage.Question{testQuestion(t, test.question)}
+		packed, err := handleQuery(clientQuery(t, 5, questions, test.ednsSize), test.maxSize)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.maxSize == maxUDPResponseSize && len(packed) > serverBufferSize {
+			t.Errorf("%s: %d byte UDP response", test.name, len(packed))
+		}
+		response := unpackResponse(t, packed)
+		want := test.answers
+		if test.truncated {
+			want = 0
+		}
+		if response.Header.Truncated != test.truncated || len(response.Answers) != want {
+			t.Errorf("%s: TC %v with %d answers in %d bytes, want TC %v with %d answers",
+				test.name, response.Header.Truncated, len(response.Answers), len(packed), test.truncated, want)
+		}
+	}
+}
+
+// TestServe runs the UDP and TCP listeners on one port and asks them through
+// udpTransport, which has to fall back to TCP for the truncated answer
+func TestServe(t *testing.T) {
+	useFakeHierarchy(t)
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Skipf("the TCP port of %s is taken: %v", udpConn.LocalAddr(), err)
+	}
+	defer tcpListener.Close()
+	go serveUDP(udpConn)
+	go serveTCP(tcpListener)
+
+	/* the resolver's own upstream lookups go to the fake, the test talks to the server directly */
+	for name, want := range map[string]int{"www.site.test.": 1, "big.site.test.": 40} {
+		question := testQuestion(t, name)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		packed, err := udpTransport{}.Exchange(ctx, udpConn.LocalAddr().String(), clientQuery(t, 321, []dnsmessage.Question{question}, 0), maxUDPResponseSize)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		response := unpackResponse(t, packed)
+		if response.Header.ID != 321 || response.Header.Truncated || len(response.Answers) != want {
+			t.Errorf("%s: %+v with %d answers, want ID 321 and %d answers", name, response.Header, len(response.Answers), want)
+		}
+	}
+}
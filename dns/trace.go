@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// traceEnabled is set with -trace. Every lookup then records each step of its
+// walk from the root down, and the steps are printed in front of its result.
+var traceEnabled = false
+
+// traceKey is the context key a lookup's trace is stored under
+type traceKey struct{}
+
+// trace collects the steps of one lookup. They are kept with the lookup
+// instead of printed right away, so lookups running at the same time don't
+// mix their steps up.
+type trace struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+// withTrace returns a context whose lookups record their steps in the returned trace
+func withTrace(ctx context.Context) (context.Context, *trace) {
+	t := &trace{}
+	return context.WithValue(ctx, traceKey{}, t), t
+}
+
+// Lines returns the steps recorded so far
+func (t *trace) Lines() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string{}, t.lines...)
+}
+
+// tracef records one line in the trace of ctx, indented by depth so the
+// lookups of nameservers without glue stand out from the main walk
+func tracef(ctx context.Context, depth int, format string, args ...interface{}) {
+	t, ok := ctx.Value(traceKey{}).(*trace)
+	if !ok {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lines = append(t.lines, strings.Repeat("  ", depth)+fmt.Sprintf(format, args...))
+}
+
+// traceResponse records one response the way dig +trace shows it: the
+// records that matter for the next step, then where they came from. For a
+// referral these are the NS set and the glue, otherwise the answer or the SOA.
+// zone is the zone the server was asked as, empty for a forwarder.
+func traceResponse(ctx context.Context, depth int, question dnsmessage.Question, zone, server string, header *dnsmessage.Header,
+	answers, authorities, additionals []dnsmessage.Resource, rtt time.Duration) {
+	if ctx.Value(traceKey{}) == nil {
+		return
+	}
+
+	for _, section := range [][]dnsmessage.Resource{answers, authorities, additionals} {
+		for _, resource := range section {
+			if resource.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			tracef(ctx, depth, "%s\t%d\tIN\t%s\t%s", resource.Header.Name, resource.Header.TTL, typeName(resource.Header.Type), recordValue(resource.Body))
+		}
+	}
+	if zone != "" {
+		server += " (zone " + zone + ")"
+	}
+	tracef(ctx, depth, ";; %s from %s for %s %s in %d ms", rcodeName(header.RCode), server,
+		question.Name, typeName(question.Type), rtt.Milliseconds())
+	tracef(ctx, depth, "")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Transport carries packed DNS messages between the resolver and a server.
+// Exchange sends query to address and returns the packed response, which the
+// resolver still checks against the query. bufferSize is the largest response
+// the query allows over UDP.
+type Transport interface {
+	Exchange(ctx context.Context, address string, query []byte, bufferSize int) ([]byte, error)
+}
+
+// TransportFunc turns a function into a Transport, which makes an in-process
+// fake of the DNS hierarchy as small as a switch on the address
+type TransportFunc func(ctx context.Context, address string, query []byte, bufferSize int) ([]byte, error)
+
+// Exchange calls f
+func (f TransportFunc) Exchange(ctx context.Context, address string, query []byte, bufferSize int) ([]byte, error) {
+	return f(ctx, address, query, bufferSize)
+}
+
+// upstreamTransport is what every query to a nameserver goes through
+var upstreamTransport Transport = udpTransport{}
+
+// udpTransport is plain DNS over UDP, retried over TCP when the answer is truncated
+type udpTransport struct{}
+
+// Exchange sends one packed query to address over UDP. Datagrams that don't
+// come from address or don't match the ID and question of the query are
+// dropped as possible spoofing attempts while we keep waiting for the real
+// answer. Every attempt gets at most queryTimeout, and less when ctx ends sooner.
+func (udpTransport) Exchange(ctx context.Context, address string, query []byte, bufferSize int) ([]byte, error) {
+	/* the ID and question to expect back come from the query itself */
+	var q dnsmessage.Parser
+	queryHeader, err := q.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := q.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	/* a fresh socket on a random port for every query */
+	conn, err := listenRandomPort()
+	if err != nil {
+		return nil, err
+	}
+	/* Close the connection */
+	defer conn.Close()
+	conn.SetDeadline(attemptDeadline(ctx))
+
+	/* send the new message to the choosen server */
+	_, err = conn.WriteTo(query, server)
+	if err != nil {
+		return nil, err
+	}
+
+	/* receive the answer to the message from the choosen server */
+	answer := make([]byte, bufferSize)
+	var header *dnsmessage.Header
+	var n int
+	for ignored := 0; ; ignored++ {
+		var from net.Addr
+		n, from, err = conn.ReadFrom(answer)
+		if err != nil {
+			if ignored > 0 {
+				return nil, fmt.Errorf("%w (ignored %d responses that didn't match the query)", err, ignored)
+			}
+			return nil, err
+		}
+		if !sameUDPAddress(from, server) {
+			continue
+		}
+		if _, header, err = parseResponse(answer[:n], queryHeader.ID, question); err == nil {
+			break
+		}
+	}
+
+	/* The TC bit means records didn't fit in the datagram, so ask the same server again over TCP */
+	if header.Truncated {
+		answer, err := tcpDnsQuery(ctx, address, query)
+		if err != nil {
+			return nil, fmt.Errorf("tcp retry of truncated answer: %w", err)
+		}
+		return answer, nil
+	}
+
+	return answer[:n], nil
+}
+
+// tcpDnsQuery sends a packed query to address over TCP and returns the packed
+// answer. Both use the 2 byte length prefix of RFC 1035 section 4.2.2.
+func tcpDnsQuery(ctx context.Context, address string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(attemptDeadline(ctx))
+
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(conn)
+}
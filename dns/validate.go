@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// useCaseRandomization turns on 0x20 encoding with -0x20: the letters of every
+// outgoing name get a random case, and the server has to echo it exactly.
+// It adds about one bit of entropy per letter an attacker has to guess.
+var useCaseRandomization = false
+
+// the range source ports are picked from, leaving out the well known ports
+const (
+	minSourcePort = 1024
+	maxSourcePort = 65535
+)
+
+// listenRandomPort opens the UDP socket for one query on a port picked with
+// crypto/rand, so an attacker has to guess the port as well as the ID. The
+// kernel picks a port itself if the random ones happen to be taken.
+func listenRandomPort() (*net.UDPConn, error) {
+	for i := 0; i < 10; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(maxSourcePort-minSourcePort+1))
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: minSourcePort + int(n.Int64())})
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return net.ListenUDP("udp", nil)
+}
+
+// parseResponse starts parsing msg and checks it answers the query we sent:
+// it must be a response with our ID and exactly our question. The returned
+// parser is positioned at the answer section.
+func parseResponse(msg []byte, id uint16, question dnsmessage.Question) (*dnsmessage.Parser, *dnsmessage.Header, error) {
+	var p dnsmessage.Parser
+	/* Get the head part of the answer */
+	header, err := p.Start(msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parser start error: %s", err)
+	}
+	if !header.Response {
+		return nil, nil, fmt.Errorf("message is not a response")
+	}
+	if header.ID != id {
+		return nil, nil, fmt.Errorf("response ID %d doesn't match query ID %d", header.ID, id)
+	}
+
+	/* Get the question part of the answer */
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(questions) != 1 {
+		return nil, nil, fmt.Errorf("answer packet doesn't have the same amount of questions")
+	}
+	if !sameQuestion(questions[0], question) {
+		return nil, nil, fmt.Errorf("response is for %s %s, not for %s %s", questions[0].Name, questions[0].Type, question.Name, question.Type)
+	}
+
+	return &p, &header, nil
+}
+
+// sameQuestion compares the question of a response with the one we sent.
+// Names are case insensitive, except with 0x20 where the case must match too.
+func sameQuestion(got, sent dnsmessage.Question) bool {
+	if got.Type != sent.Type || got.Class != sent.Class {
+		return false
+	}
+	if useCaseRandomization {
+		return got.Name.String() == sent.Name.String()
+	}
+	return strings.EqualFold(got.Name.String(), sent.Name.String())
+}
+
+// sameUDPAddress reports whether a datagram came from the server we asked
+func sameUDPAddress(from net.Addr, server *net.UDPAddr) bool {
+	udpFrom, ok := from.(*net.UDPAddr)
+	return ok && udpFrom.IP.Equal(server.IP) && udpFrom.Port == server.Port
+}
+
+// randomizeCase flips the case of each letter of name at random for 0x20 encoding
+func randomizeCase(name dnsmessage.Name) (dnsmessage.Name, error) {
+	letters := []byte(name.String())
+	random := make([]byte, len(letters))
+	if _, err := rand.Read(random); err != nil {
+		return dnsmessage.Name{}, err
+	}
+
+	for i, c := range letters {
+		if random[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			letters[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			letters[i] = c - 'A' + 'a'
+		}
+	}
+	return dnsmessage.NewName(string(letters))
+}
+
+// inBailiwick keeps the records whose owner is zone or lies below it. A server
+// is only an authority for its own zone, so records it sends about any other
+// name are dropped before they're used as next hop or written to the cache.
+func inBailiwick(resources []dnsmessage.Resource, zone string) []dnsmessage.Resource {
+	kept := make([]dnsmessage.Resource, 0, len(resources))
+	for _, resource := range resources {
+		if isSubdomain(resource.Header.Name.String(), zone) {
+			kept = append(kept, resource)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testQuestion builds an A question for name
+func testQuestion(t *testing.T, name string) dnsmessage.Question {
+	t.Helper()
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+}
+
+// testMessage packs a message with one question and, for responses, one A record
+func testMessage(t *testing.T, id uint16, response bool, question dnsmessage.Question, a [4]byte) []byte {
+	t.Helper()
+	message := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: response},
+		Questions: []dnsmessage.Question{question},
+	}
+	if response {
+		message.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+	packed, err := message.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func TestParseResponse(t *testing.T) {
+	defer func(old bool) { useCaseRandomization = old }(useCaseRandomization)
+	useCaseRandomization = true
+
+	sent := testQuestion(t, "WwW.ExAmPle.org.")
+	other := testQuestion(t, "www.example.net.")
+	lower := testQuestion(t, "www.example.org.")
+	aaaa := sent
+	aaaa.Type = dnsmessage.TypeAAAA
+
+	tests := []struct {
+		name string
+		msg  []byte
+		ok   bool
+	}{
+		{"real reply", testMessage(t, 1234, true, sent, [4]byte{192, 0, 2, 1}), true},
+		{"not a response", testMessage(t, 1234, false, sent, [4]byte{}), false},
+		{"wrong ID", testMessage(t, 4321, true, sent, [4]byte{192, 0, 2, 66}), false},
+		{"wrong name", testMessage(t, 1234, true, other, [4]byte{192, 0, 2, 66}), false},
+		{"wrong type", testMessage(t, 1234, true, aaaa, [4]byte{192, 0, 2, 66}), false},
+		{"wrong 0x20 case", testMessage(t, 1234, true, lower, [4]byte{192, 0, 2, 66}), false},
+		{"garbage", []byte{1, 2, 3}, false},
+	}
+	for _, test := range tests {
+		_, _, err := parseResponse(test.msg, 1234, sent)
+		if test.ok && err != nil {
+			t.Errorf("%s: rejected: %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+
+	/* without 0x20 the case of the name doesn't matter */
+	useCaseRandomization = false
+	if _, _, err := parseResponse(testMessage(t, 1234, true, lower, [4]byte{192, 0, 2, 1}), 1234, sent); err != nil {
+		t.Errorf("different case without 0x20: rejected: %v", err)
+	}
+}
+
+// TestUDPTransportDropsForgeries answers every query with forgeries first, a
+// wrong ID, a wrong question, the wrong 0x20 case and a reply from another
+// port, and then the real reply, which is the only one Exchange may return
+func TestUDPTransportDropsForgeries(t *testing.T) {
+	defer func(old bool) { useCaseRandomization = old }(useCaseRandomization)
+	useCaseRandomization = true
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	spoofer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+
+	sent := testQuestion(t, "WwW.ExAmPle.org.")
+	query := testMessage(t, 1234, false, sent, [4]byte{})
+	genuine := testMessage(t, 1234, true, sent, [4]byte{192, 0, 2, 1})
+	forged := [][]byte{
+		testMessage(t, 4321, true, sent, [4]byte{192, 0, 2, 66}),
+		testMessage(t, 1234, true, testQuestion(t, "www.example.net."), [4]byte{192, 0, 2, 66}),
+		testMessage(t, 1234, true, testQuestion(t, "www.example.org."), [4]byte{192, 0, 2, 66}),
+	}
+
+	go func() {
+		buffer := make([]byte, 512)
+		n, client, err := server.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(buffer[:n], query) {
+			t.Errorf("server got %x, want the query %x", buffer[:n], query)
+		}
+		/* the real answer from the wrong source address */
+		spoofer.WriteTo(genuine, client)
+		for _, msg := range forged {
+			server.WriteTo(msg, client)
+		}
+		server.WriteTo(genuine, client)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	answer, err := udpTransport{}.Exchange(ctx, server.LocalAddr().String(), query, 512)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if !bytes.Equal(answer, genuine) {
+		t.Fatalf("Exchange returned %x, want the real reply %x", answer, genuine)
+	}
+}
+
+// TestUDPTransportOnlyForgeries makes sure Exchange times out instead of
+// returning a forgery when the real reply never comes
+func TestUDPTransportOnlyForgeries(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	sent := testQuestion(t, "www.example.org.")
+	query := testMessage(t, 1234, false, sent, [4]byte{})
+	forged := testMessage(t, 4321, true, sent, [4]byte{192, 0, 2, 66})
+	go func() {
+		buffer := make([]byte, 512)
+		_, client, err := server.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		server.WriteTo(forged, client)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if answer, err := (udpTransport{}).Exchange(ctx, server.LocalAddr().String(), query, 512); err == nil {
+		t.Fatalf("Exchange accepted a forgery: %x", answer)
+	}
+}
+
+func TestInBailiwick(t *testing.T) {
+	resources := []dnsmessage.Resource{
+		fakeA("site.test.", 192, 0, 2, 1),
+		fakeA("www.site.test.", 192, 0, 2, 2),
+		fakeA("WWW.Site.Test.", 192, 0, 2, 3),
+		fakeA("test.", 192, 0, 2, 4),
+		fakeA("badsite.test.", 192, 0, 2, 5),
+		fakeA("www.example.", 192, 0, 2, 6),
+	}
+	tests := map[string][]string{
+		".":          {"site.test.", "www.site.test.", "WWW.Site.Test.", "test.", "badsite.test.", "www.example."},
+		"test.":      {"site.test.", "www.site.test.", "WWW.Site.Test.", "test.", "badsite.test."},
+		"site.test.": {"site.test.", "www.site.test.", "WWW.Site.Test."},
+		"example.":   {"www.example."},
+		"org.":       {},
+	}
+	for zone, want := range tests {
+		kept := inBailiwick(resources, zone)
+		got := []string{}
+		for _, resource := range kept {
+			got = append(got, resource.Header.Name.String())
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("zone %s kept %v, want %v", zone, got, want)
+		}
+	}
+}
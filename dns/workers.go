@@ -0,0 +1,51 @@
+package main
+
+import "sync"
+
+// concurrency is how many names are resolved at the same time, set with -concurrency
+var concurrency = 8
+
+// resolveInOrder resolves names with concurrency workers. All of them share
+// resolverCache, so a zone one worker walked is reused by the others.
+// resolveName returns the output lines of one name, and print gets them in the
+// order of names as soon as a name and every name before it are done.
+func resolveInOrder(names []string, resolveName func(name string) []string, print func(lines []string)) {
+	workers := concurrency
+	if workers > len(names) {
+		workers = len(names)
+	}
+
+	/* every name gets its own slot, so the workers never write to the same place */
+	results := make([][]string, len(names))
+	done := make([]chan struct{}, len(names))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = resolveName(names[i])
+				close(done[i])
+			}
+		}()
+	}
+
+	go func() {
+		for i := range names {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	/* wait for the names in input order, a slow name holds back the ones after it */
+	for i := range names {
+		<-done[i]
+		print(results[i])
+	}
+	wg.Wait()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolveInOrder(t *testing.T) {
+	defer func(old int) { concurrency = old }(concurrency)
+
+	tests := []struct {
+		name        string
+		names       int
+		concurrency int
+		reverse     bool // every name waits for the one after it, so they finish last to first
+	}{
+		{"no names", 0, 4, false},
+		{"one worker", 5, 1, false},
+		{"fewer workers than names", 9, 3, false},
+		{"more workers than names", 3, 8, false},
+		{"finishing in reverse", 6, 6, true},
+	}
+	for _, test := range tests {
+		concurrency = test.concurrency
+		names := []string{}
+		index := map[string]int{}
+		release := []chan struct{}{}
+		for i := 0; i < test.names; i++ {
+			name := fmt.Sprintf("name%d.test", i)
+			names = append(names, name)
+			index[name] = i
+			release = append(release, make(chan struct{}))
+		}
+
+		var mu sync.Mutex
+		running, mostRunning := 0, 0
+		finished, printed := []string{}, []string{}
+		resolveName := func(name string) []string {
+			mu.Lock()
+			running++
+			if running > mostRunning {
+				mostRunning = running
+			}
+			mu.Unlock()
+
+			i := index[name]
+			if test.reverse && i < len(names)-1 {
+				<-release[i]
+			} else {
+				time.Sleep(time.Duration(i%3) * time.Millisecond)
+			}
+
+			mu.Lock()
+			running--
+			finished = append(finished, name)
+			mu.Unlock()
+			/* let the name before this one finish now */
+			if i > 0 {
+				close(release[i-1])
+			}
+			return []string{name + ",first", name + ",second"}
+		}
+
+		resolveInOrder(names, resolveName, func(lines []string) {
+			printed = append(printed, lines...)
+		})
+
+		want := []string{}
+		for _, name := range names {
+			want = append(want, name+",first", name+",second")
+		}
+		if strings.Join(printed, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: printed %v, want %v", test.name, printed, want)
+		}
+		if mostRunning > test.concurrency {
+			t.Errorf("%s: %d names resolved at the same time, want at most %d", test.name, mostRunning, test.concurrency)
+		}
+		if test.reverse && (len(finished) == 0 || finished[0] != names[len(names)-1]) {
+			t.Errorf("%s: finished in the order %v, want the last name first", test.name, finished)
+		}
+	}
+}
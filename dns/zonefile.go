@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultZoneTTL is the TTL of records in a zone file without $TTL or a TTL of their own
+const defaultZoneTTL = 3600
+
+// zoneLine is one entry of a zone file. Parentheses can spread an entry over
+// several lines of the file, number is the first of them.
+type zoneLine struct {
+	number     int
+	blankOwner bool // the entry starts with white space, so it belongs to the previous owner
+	fields     []string
+}
+
+// parseZoneFile reads a zone file in the master file format of RFC 1035
+// section 5.1. $ORIGIN and $TTL are supported, $INCLUDE isn't. Names that
+// don't end in a dot are relative to the origin, @ is the origin itself.
+func parseZoneFile(path string) ([]dnsmessage.Resource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := splitZoneLines(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	origin, owner := "", ""
+	ttl := uint32(defaultZoneTTL)
+	resources := []dnsmessage.Resource{}
+	for _, line := range lines {
+		fields := line.fields
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s line %d: %s", path, line.number, fmt.Sprintf(format, args...))
+		}
+
+		/* control entries change how the following entries are read */
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) != 2 || !strings.HasSuffix(fields[1], ".") {
+				return nil, fail("$ORIGIN needs one fully qualified name")
+			}
+			origin = strings.ToLower(fields[1])
+			continue
+		case "$TTL":
+			if len(fields) != 2 {
+				return nil, fail("$TTL needs one value")
+			}
+			if ttl, err = parseTTL(fields[1]); err != nil {
+				return nil, fail("%v", err)
+			}
+			continue
+		case "$INCLUDE":
+			return nil, fail("$INCLUDE is not supported")
+		}
+
+		if !line.blankOwner {
+			if owner, err = absoluteName(fields[0], origin); err != nil {
+				return nil, fail("%v", err)
+			}
+			fields = fields[1:]
+		} else if owner == "" {
+			return nil, fail("the first record needs an owner name")
+		}
+
+		/* the TTL and the class are both optional and can come in either order */
+		recordTTL := ttl
+		for i := 0; i < 2 && len(fields) > 0; i++ {
+			if value, err := parseTTL(fields[0]); err == nil {
+				recordTTL = value
+				fields = fields[1:]
+			} else if strings.EqualFold(fields[0], "IN") {
+				fields = fields[1:]
+			}
+		}
+		if len(fields) == 0 {
+			return nil, fail("missing record type")
+		}
+
+		typ, body, err := parseRData(strings.ToUpper(fields[0]), fields[1:], origin)
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		name, err := dnsmessage.NewName(owner)
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		resources = append(resources, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET, TTL: recordTTL},
+			Body:   body,
+		})
+	}
+	return resources, nil
+}
+
+// parseRData reads the data of one record of type typ
+func parseRData(typ string, fields []string, origin string) (dnsmessage.Type, dnsmessage.ResourceBody, error) {
+	want := map[string]int{"A": 1, "AAAA": 1, "NS": 1, "CNAME": 1, "PTR": 1, "MX": 2, "SRV": 4, "SOA": 7, "CAA": 3}
+	if count, ok := want[typ]; ok && len(fields) != count {
+		return 0, nil, fmt.Errorf("%s record needs %d fields, not %d", typ, count, len(fields))
+	}
+
+	switch typ {
+	case "A":
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil {
+			return 0, nil, fmt.Errorf("bad IPv4 address %s", fields[0])
+		}
+		record := &dnsmessage.AResource{}
+		copy(record.A[:], ip)
+		return dnsmessage.TypeA, record, nil
+
+	case "AAAA":
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil {
+			return 0, nil, fmt.Errorf("bad IPv6 address %s", fields[0])
+		}
+		record := &dnsmessage.AAAAResource{}
+		copy(record.AAAA[:], ip)
+		return dnsmessage.TypeAAAA, record, nil
+
+	case "NS", "CNAME", "PTR":
+		target, err := zoneName(fields[0], origin)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch typ {
+		case "NS":
+			return dnsmessage.TypeNS, &dnsmessage.NSResource{NS: target}, nil
+		case "CNAME":
+			return dnsmessage.TypeCNAME, &dnsmessage.CNAMEResource{CNAME: target}, nil
+		}
+		return dnsmessage.TypePTR, &dnsmessage.PTRResource{PTR: target}, nil
+
+	case "MX":
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return 0, nil, fmt.Errorf("bad MX preference %s", fields[0])
+		}
+		exchange, err := zoneName(fields[1], origin)
+		if err != nil {
+			return 0, nil, err
+		}
+		return dnsmessage.TypeMX, &dnsmessage.MXResource{Pref: uint16(pref), MX: exchange}, nil
+
+	case "SRV":
+		numbers := [3]uint16{}
+		for i := range numbers {
+			value, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return 0, nil, fmt.Errorf("bad SRV number %s", fields[i])
+			}
+			numbers[i] = uint16(value)
+		}
+		target, err := zoneName(fields[3], origin)
+		if err != nil {
+			return 0, nil, err
+		}
+		return dnsmessage.TypeSRV, &dnsmessage.SRVResource{Priority: numbers[0], Weight: numbers[1], Port: numbers[2], Target: target}, nil
+
+	case "SOA":
+		ns, err := zoneName(fields[0], origin)
+		if err != nil {
+			return 0, nil, err
+		}
+		mbox, err := zoneName(fields[1], origin)
+		if err != nil {
+			return 0, nil, err
+		}
+		// the serial is a plain number, the timers may use units like 1h
+		serial, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return 0, nil, fmt.Errorf("bad SOA serial %s", fields[2])
+		}
+		timers := [4]uint32{}
+		for i := range timers {
+			if timers[i], err = parseTTL(fields[3+i]); err != nil {
+				return 0, nil, err
+			}
+		}
+		return dnsmessage.TypeSOA, &dnsmessage.SOAResource{NS: ns, MBox: mbox, Serial: uint32(serial),
+			Refresh: timers[0], Retry: timers[1], Expire: timers[2], MinTTL: timers[3]}, nil
+
+	case "TXT":
+		if len(fields) == 0 {
+			return 0, nil, fmt.Errorf("TXT record needs at least one string")
+		}
+		texts := []string{}
+		for _, field := range fields {
+			text := strings.TrimPrefix(field, `"`)
+			if len(text) > 255 {
+				return 0, nil, fmt.Errorf("TXT string is longer than 255 bytes")
+			}
+			texts = append(texts, text)
+		}
+		return dnsmessage.TypeTXT, &dnsmessage.TXTResource{TXT: texts}, nil
+
+	case "CAA":
+		// flags tag "value", encoded the way formatCAA decodes it
+		flags, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return 0, nil, fmt.Errorf("bad CAA flags %s", fields[0])
+		}
+		tag, value := fields[1], strings.TrimPrefix(fields[2], `"`)
+		if tag == "" || len(tag) > 255 {
+			return 0, nil, fmt.Errorf("bad CAA tag %s", tag)
+		}
+		data := append([]byte{byte(flags), byte(len(tag))}, tag...)
+		return typeCAA, &dnsmessage.UnknownResource{Type: typeCAA, Data: append(data, value...)}, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported record type %s", typ)
+}
+
+// splitZoneLines cuts a zone file into entries of fields. Comments start at
+// a ; outside quotes, and parentheses continue an entry on the next lines.
+// A quoted string becomes one field that starts with a " and has its escapes
+// resolved, so quoted and unquoted text can be told apart.
+func splitZoneLines(data string) ([]zoneLine, error) {
+	lines := []zoneLine{}
+	var current zoneLine
+	depth := 0
+
+	for number, text := range strings.Split(data, "\n") {
+		if depth == 0 {
+			current = zoneLine{number: number + 1, blankOwner: text != "" && (text[0] == ' ' || text[0] == '\t')}
+		}
+
+		field, inField := []byte{}, false
+		flush := func() {
+			if inField {
+				current.fields = append(current.fields, string(field))
+			}
+			field, inField = []byte{}, false
+		}
+
+		for i := 0; i < len(text); i++ {
+			c := text[i]
+			switch {
+			case c == ';':
+				i = len(text)
+			case c == ' ' || c == '\t' || c == '\r':
+				flush()
+			case c == '(':
+				flush()
+				depth++
+			case c == ')':
+				flush()
+				if depth--; depth < 0 {
+					return nil, fmt.Errorf("line %d: ) without (", number+1)
+				}
+			case c == '"':
+				flush()
+				quoted := []byte{'"'}
+				for i++; i < len(text) && text[i] != '"'; i++ {
+					if text[i] != '\\' || i+1 >= len(text) {
+						quoted = append(quoted, text[i])
+						continue
+					}
+					/* \DDD is a byte in decimal, any other escaped character stands for itself */
+					if i+3 < len(text) && isNumber(text[i+1:i+4]) {
+						value, _ := strconv.Atoi(text[i+1 : i+4])
+						quoted = append(quoted, byte(value))
+						i += 3
+					} else {
+						quoted = append(quoted, text[i+1])
+						i++
+					}
+				}
+				if i >= len(text) {
+					return nil, fmt.Errorf("line %d: unterminated string", number+1)
+				}
+				current.fields = append(current.fields, string(quoted))
+			default:
+				field = append(field, c)
+				inField = true
+			}
+		}
+		flush()
+
+		if depth == 0 && len(current.fields) > 0 {
+			lines = append(lines, current)
+		}
+	}
+
+	if depth != 0 {
+		return nil, fmt.Errorf("line %d: ( without )", current.number)
+	}
+	return lines, nil
+}
+
+// absoluteName makes name fully qualified, relative names are under origin
+func absoluteName(name, origin string) (string, error) {
+	switch {
+	case name == "@":
+		name = origin
+	case strings.HasSuffix(name, "."):
+	case origin == "":
+		return "", fmt.Errorf("relative name %s without $ORIGIN", name)
+	case origin == ".":
+		name += "."
+	default:
+		name += "." + origin
+	}
+	if name == "" {
+		return "", fmt.Errorf("@ without $ORIGIN")
+	}
+	return strings.ToLower(name), nil
+}
+
+// zoneName reads a name in record data, which may be relative to origin as well
+func zoneName(name, origin string) (dnsmessage.Name, error) {
+	absolute, err := absoluteName(name, origin)
+	if err != nil {
+		return dnsmessage.Name{}, err
+	}
+	return dnsmessage.NewName(absolute)
+}
+
+// parseTTL reads a TTL in seconds, or with the units BIND allows, like 1h30m or 2d
+func parseTTL(value string) (uint32, error) {
+	if isNumber(value) {
+		ttl, err := strconv.ParseUint(value, 10, 32)
+		return uint32(ttl), err
+	}
+
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total, number uint64
+	digits := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= '0' && c <= '9' {
+			number = number*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		unit, ok := units[c|0x20]
+		if !ok || !digits {
+			return 0, fmt.Errorf("bad TTL %s", value)
+		}
+		total += number * unit
+		number, digits = 0, false
+	}
+	if value == "" || digits || total > 1<<31-1 {
+		return 0, fmt.Errorf("bad TTL %s", value)
+	}
+	return uint32(total), nil
+}
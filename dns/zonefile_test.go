@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func writeZone(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zone")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// zoneRecordString formats a parsed record as "name TTL TYPE data" for comparing
+func zoneRecordString(record dnsmessage.Resource) string {
+	data := ""
+	switch body := record.Body.(type) {
+	case *dnsmessage.AResource:
+		data = net.IP(body.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		data = net.IP(body.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		data = body.CNAME.String()
+	case *dnsmessage.NSResource:
+		data = body.NS.String()
+	case *dnsmessage.MXResource:
+		data = fmt.Sprintf("%d %s", body.Pref, body.MX)
+	case *dnsmessage.SOAResource:
+		data = fmt.Sprintf("%s %s %d %d %d %d %d", body.NS, body.MBox, body.Serial, body.Refresh, body.Retry, body.Expire, body.MinTTL)
+	case *dnsmessage.TXTResource:
+		data = fmt.Sprintf("%q", body.TXT)
+	}
+	return fmt.Sprintf("%s %d %s %s", record.Header.Name, record.Header.TTL, typeName(record.Header.Type), data)
+}
+
+func TestParseZoneFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"$ORIGIN and relative names", `$ORIGIN Example.Test.
+@        IN SOA ns hostmaster 1 3600 600 86400 60
+www         A   192.0.2.1
+mail.other.test. MX 10 mx
+`, []string{
+			"example.test. 3600 SOA ns.example.test. hostmaster.example.test. 1 3600 600 86400 60",
+			"www.example.test. 3600 A 192.0.2.1",
+			"mail.other.test. 3600 MX 10 mx.example.test.",
+		}},
+		{"$TTL and a blank owner", `$ORIGIN example.test.
+$TTL 300
+www  A     192.0.2.1
+     AAAA  2001:db8::1
+$TTL 1h
+mail A     192.0.2.2
+`, []string{
+			"www.example.test. 300 A 192.0.2.1",
+			"www.example.test. 300 AAAA 2001:db8::1",
+			"mail.example.test. 3600 A 192.0.2.2",
+		}},
+		{"parentheses over several lines", `$ORIGIN example.test.
+@ 60 IN SOA ns.example.test. hostmaster.example.test. (
+        2024010101 ; serial
+        1h         ; refresh, with a ( in the comment
+        10m 1w
+        5m )
+www A 192.0.2.1
+`, []string{
+			"example.test. 60 SOA ns.example.test. hostmaster.example.test. 2024010101 3600 600 604800 300",
+			"www.example.test. 3600 A 192.0.2.1",
+		}},
+		{"quoted strings and escapes", `$ORIGIN example.test.
+txt TXT "a \"quoted\" word; not a comment" "\065\066" plain
+`, []string{
+			`txt.example.test. 3600 TXT ["a \"quoted\" word; not a comment" "AB" "plain"]`,
+		}},
+		{"TTL units", `$ORIGIN example.test.
+a 1h30m A 192.0.2.1
+b 2D    A 192.0.2.2
+c 1w1s  A 192.0.2.3
+d 90    A 192.0.2.4
+`, []string{
+			"a.example.test. 5400 A 192.0.2.1",
+			"b.example.test. 172800 A 192.0.2.2",
+			"c.example.test. 604801 A 192.0.2.3",
+			"d.example.test. 90 A 192.0.2.4",
+		}},
+		{"TTL and class in either order", `$ORIGIN example.test.
+a 600 IN A 192.0.2.1
+b IN 600 A 192.0.2.2
+c in     A 192.0.2.3
+d 600    A 192.0.2.4
+`, []string{
+			"a.example.test. 600 A 192.0.2.1",
+			"b.example.test. 600 A 192.0.2.2",
+			"c.example.test. 3600 A 192.0.2.3",
+			"d.example.test. 600 A 192.0.2.4",
+		}},
+	}
+	for _, test := range tests {
+		records, err := parseZoneFile(writeZone(t, test.content))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := []string{}
+		for _, record := range records {
+			got = append(got, zoneRecordString(record))
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestParseZoneFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"( without )":                  "$ORIGIN example.test.\n@ SOA ns hostmaster ( 1 3600 600 86400 60\n",
+		") without (":                  "$ORIGIN example.test.\nwww A 192.0.2.1 )\n",
+		"unterminated string":          "$ORIGIN example.test.\ntxt TXT \"open\n",
+		"$INCLUDE":                     "$INCLUDE other.zone\n",
+		"relative name without origin": "www A 192.0.2.1\n",
+		"relative $ORIGIN":             "$ORIGIN example.test\n",
+		"bad TTL unit":                 "$ORIGIN example.test.\n$TTL 1x\n",
+		"missing record type":          "$ORIGIN example.test.\nwww 300 IN\n",
+		"blank owner first":            "$ORIGIN example.test.\n  A 192.0.2.1\n",
+		"wrong field count":            "$ORIGIN example.test.\nmail MX mx\n",
+		"unsupported type":             "$ORIGIN example.test.\nwww HINFO cpu os\n",
+	}
+	for name, content := range tests {
+		if records, err := parseZoneFile(writeZone(t, content)); err == nil {
+			t.Errorf("%s: accepted, got %d records", name, len(records))
+		}
+	}
+}